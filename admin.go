@@ -0,0 +1,454 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	roleNone uint8 = iota
+	roleBanned
+	roleUser
+	roleAdmin
+)
+
+const (
+	denied = `I'm sorry but my permissions do not allow you to use this service.`
+	admins = `
+
+Administrator commands:
+/users
+/stats
+/audit [@twitter user|chat id] [count]
+/broadcast <message>
+/invite [uses] [duration]
+/allow <@username|user id> [admin]
+/ban <@username|user id>
+/quota <@username|user id> <subscriptions|default> [keywords]`
+)
+
+// spread is the time to wait between each message sent by a broadcast, this
+// keeps us under the Telegram limit of 30 messages a second.
+const spread = time.Millisecond * 100
+
+func roleName(r uint8) string {
+	switch r {
+	case roleBanned:
+		return "banned"
+	case roleUser:
+		return "user"
+	case roleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+func (w *Watcher) role(x context.Context, u *telegram.User) uint8 {
+	if _, err := w.sql.ExecContext(x, "user_seen", u.ID, sql.NullString{String: u.UserName, Valid: len(u.UserName) > 0}); err != nil {
+		w.log.Error("Error updating Telegram user %d in database: %s!", u.ID, err.Error())
+		return roleNone
+	}
+	r, ok := w.sql.QueryRowContext(x, "user_get", u.ID)
+	if !ok {
+		return roleNone
+	}
+	var v uint8
+	if err := r.Scan(&v); err != nil {
+		w.log.Error("Error getting Telegram user %d role from database: %s!", u.ID, err.Error())
+		return roleNone
+	}
+	if v != roleNone {
+		return v
+	}
+	// NOTE(dij): Users that have not been given a role yet are checked against
+	//            the (legacy) config username lists. Any matches are stored
+	//            so they no longer depend on the username.
+	if v = canUseACL(u.UserName, w.allowed, w.blocked); v == roleNone {
+		if w.private {
+			return roleNone
+		}
+		return roleUser
+	}
+	if _, err := w.sql.ExecContext(x, "user_set", u.ID, v); err != nil {
+		w.log.Error("Error updating Telegram user %d role in database: %s!", u.ID, err.Error())
+	}
+	return v
+}
+func (w *Watcher) isAdmin(x context.Context, u int64) bool {
+	r, ok := w.sql.QueryRowContext(x, "user_get", u)
+	if !ok {
+		return false
+	}
+	var v uint8
+	if err := r.Scan(&v); err != nil {
+		return false
+	}
+	return v == roleAdmin
+}
+func (w *Watcher) target(x context.Context, s string) (int64, string) {
+	if len(s) == 0 {
+		return 0, invalid
+	}
+	if s[0] != '@' {
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || i <= 0 {
+			return 0, `I'm sorry, but "` + s + `" is not a valid Telegram user ID or username!`
+		}
+		return i, ""
+	}
+	r, ok := w.sql.QueryRowContext(x, "user_find", s[1:])
+	if !ok {
+		return 0, errmsg
+	}
+	var i int64
+	switch err := r.Scan(&i); err {
+	case nil:
+		return i, ""
+	case sql.ErrNoRows:
+	default:
+		w.log.Error("Error getting Telegram user %q from database: %s!", s, err.Error())
+		return 0, errmsg
+	}
+	return 0, `I'm sorry, but I have not seen the user ` + s + ` before.` + "\n\nAsk them to send me a message first or use their Telegram user ID instead."
+}
+func (w *Watcher) admin(x context.Context, u int64, v, s string) string {
+	switch v {
+	case "users":
+		return w.users(x)
+	case "invite":
+		return w.invite(x, u, s)
+	case "audit":
+		return w.audit(x, s)
+	}
+	var a string
+	if e := strings.IndexByte(s, ' '); e > 0 {
+		s, a = s[:e], strings.TrimSpace(s[e+1:])
+	}
+	i, msg := w.target(x, s)
+	if len(msg) > 0 {
+		return msg
+	}
+	if v == "quota" {
+		return w.setQuota(x, i, s, a)
+	}
+	r := roleBanned
+	if v == "allow" {
+		switch r = roleUser; {
+		case len(a) == 0:
+		case stringLowMatch(a, "admin"):
+			r = roleAdmin
+		default:
+			return invalid
+		}
+	}
+	if _, err := w.sql.ExecContext(x, "user_set", i, r); err != nil {
+		w.log.Error("Error updating Telegram user %d role in database: %s!", i, err.Error())
+		return errmsg
+	}
+	w.log.Info("Telegram user %s (%d) role was changed to %s.", s, i, roleName(r))
+	return "Awesome! The user " + s + " is now marked as \"" + roleName(r) + "\"."
+}
+func (w *Watcher) users(x context.Context) string {
+	r, err := w.sql.QueryContext(x, "user_list")
+	if err != nil {
+		w.log.Error("Error getting Telegram users from database: %s!", err.Error())
+		return errmsg
+	}
+	var (
+		c int
+		i int64
+		v uint8
+		n sql.NullString
+		b = builders.Get().(*strings.Builder)
+	)
+	for b.WriteString("These are the users that I know about:\n"); r.Next(); {
+		if err := r.Scan(&i, &n, &v); err != nil {
+			w.log.Error("Error scanning data into Telegram users from database: %s!", err.Error())
+			continue
+		}
+		if b.WriteString("- " + strconv.FormatInt(i, 10)); n.Valid {
+			b.WriteString(" (@" + n.String + ")")
+		}
+		b.WriteString(": " + roleName(v) + "\n")
+		c++
+	}
+	r.Close()
+	s := b.String()
+	b.Reset()
+	if builders.Put(b); c == 0 {
+		return "There are currently no users with a role."
+	}
+	return s
+}
+func (w *Watcher) audit(x context.Context, s string) string {
+	var (
+		c    int64
+		n, a string
+		l    = uint64(25)
+	)
+	if z := strings.IndexByte(s, ' '); z > 0 {
+		s, a = s[:z], strings.TrimSpace(s[z+1:])
+	}
+	switch {
+	case len(s) == 0:
+	case s[0] == '@':
+		if !isValid(s) {
+			return `The username "` + s + `" is not a valid Twitter username!`
+		}
+		n = s[1:]
+	default:
+		var err error
+		if c, err = strconv.ParseInt(s, 10, 64); err != nil || c == 0 {
+			return `I'm sorry, but "` + s + `" is not a valid Twitter username or Telegram chat ID!`
+		}
+	}
+	if len(a) > 0 {
+		var err error
+		if l, err = strconv.ParseUint(a, 10, 8); err != nil || l == 0 || l > 100 {
+			return `I'm sorry, but "` + a + `" is not a valid amount! It must be between 1 and 100.`
+		}
+	}
+	r, err := w.sql.QueryContext(x, "audit", c, c, n, n, l)
+	if err != nil {
+		w.log.Error("Error getting audit log from database: %s!", err.Error())
+		return errmsg
+	}
+	var (
+		k       int
+		t, v    string
+		i, e    int64
+		m, o, f sql.NullString
+		b       = builders.Get().(*strings.Builder)
+	)
+	for b.WriteString("These are the latest audit log entries:\n"); r.Next(); {
+		if err := r.Scan(&t, &i, &e, &v, &m, &o, &f); err != nil {
+			w.log.Error("Error scanning data into audit log from database: %s!", err.Error())
+			continue
+		}
+		if b.WriteString("- " + t + " "); e != 0 {
+			b.WriteString("chat " + strconv.FormatInt(e, 10) + " ")
+		}
+		if i == 0 {
+			b.WriteString("by system: " + v)
+		} else {
+			b.WriteString("by " + strconv.FormatInt(i, 10) + ": " + v)
+		}
+		if m.Valid {
+			b.WriteString(" @" + m.String)
+		}
+		if o.Valid || f.Valid {
+			b.WriteString(" [" + o.String + " => " + f.String + "]")
+		}
+		b.WriteByte('\n')
+		k++
+	}
+	r.Close()
+	s = b.String()
+	b.Reset()
+	if builders.Put(b); k == 0 {
+		return "There are no audit log entries that match."
+	}
+	return s
+}
+func (w *Watcher) setQuota(x context.Context, i int64, s, a string) string {
+	var (
+		k, p string
+		q, e sql.NullInt64
+	)
+	if z := strings.IndexByte(a, ' '); z > 0 {
+		a, k = a[:z], strings.TrimSpace(a[z+1:])
+	}
+	switch {
+	case len(a) == 0:
+		return invalid
+	case stringLowMatch(a, "default"):
+	default:
+		n, err := strconv.ParseUint(a, 10, 31)
+		if err != nil {
+			return `I'm sorry, but "` + a + `" is not a valid subscription limit!`
+		}
+		q.Int64, q.Valid = int64(n), true
+	}
+	if len(k) > 0 {
+		n, err := strconv.ParseUint(k, 10, 16)
+		if err != nil || n == 0 || n > 256 {
+			return `I'm sorry, but "` + k + `" is not a valid keyword limit! It must be between 1 and 256.`
+		}
+		e.Int64, e.Valid = int64(n), true
+	}
+	if _, err := w.sql.ExecContext(x, "quota_set", i, q, e); err != nil {
+		w.log.Error("Error updating quota for user %d in database: %s!", i, err.Error())
+		return errmsg
+	}
+	if p = "the default"; q.Valid {
+		if p = strconv.FormatInt(q.Int64, 10); q.Int64 == 0 {
+			p = "unlimited"
+		}
+	}
+	return "Awesome! The user " + s + " can now follow " + p + " users per chat."
+}
+func (w *Watcher) invite(x context.Context, u int64, s string) string {
+	var (
+		n       = uint64(1)
+		d       sql.NullInt64
+		a, k, e = s, "", error(nil)
+	)
+	if z := strings.IndexByte(s, ' '); z > 0 {
+		a, k = s[:z], strings.TrimSpace(s[z+1:])
+	}
+	if len(a) > 0 {
+		if n, e = strconv.ParseUint(a, 10, 16); e != nil || n == 0 {
+			return `I'm sorry, but "` + a + `" is not a valid amount of uses!`
+		}
+	}
+	if len(k) > 0 {
+		t, ok := parseDuration(k)
+		if !ok {
+			return `I'm sorry, but "` + k + `" is not a valid duration!` + "\n\nDurations look like \"30m\", \"12h\" or \"7d\"."
+		}
+		d.Int64, d.Valid = int64(t.Seconds()), true
+	}
+	var b [12]byte
+	if _, e = rand.Read(b[:]); e != nil {
+		w.log.Error("Error generating invite code: %s!", e.Error())
+		return errmsg
+	}
+	c := base64.RawURLEncoding.EncodeToString(b[:])
+	if _, e = w.sql.ExecContext(x, "invite_add", c, u, n, d); e != nil {
+		w.log.Error("Error adding invite code to database: %s!", e.Error())
+		return errmsg
+	}
+	w.log.Info("Telegram user %d created invite code %q with %d uses.", u, c, n)
+	r := "Awesome! Here is your invite link, it can be used " + strconv.FormatUint(n, 10) + " time(s)"
+	if d.Valid {
+		r += " in the next " + k
+	}
+	return r + ":\n\nhttps://t.me/" + w.bot.Self.UserName + "?start=" + c
+}
+func (w *Watcher) redeem(x context.Context, u int64, c string) bool {
+	if len(c) == 0 || len(c) > 32 {
+		return false
+	}
+	r, err := w.sql.QueryContext(x, "invite_use", c, u)
+	if err != nil {
+		w.log.Error("Error redeeming invite code %q for user %d: %s!", c, u, err.Error())
+		return false
+	}
+	var v int
+	for r.Next() {
+		if err = r.Scan(&v); err != nil {
+			w.log.Error("Error scanning invite code %q result for user %d: %s!", c, u, err.Error())
+		}
+	}
+	if r.Close(); v != 1 {
+		return false
+	}
+	w.log.Info("Telegram user %d redeemed invite code %q.", u, c)
+	return true
+}
+func (w *Watcher) chats(x context.Context) ([]int64, error) {
+	r, err := w.sql.QueryContext(x, "chats")
+	if err != nil {
+		return nil, err
+	}
+	var (
+		l []int64
+		i int64
+	)
+	for r.Next() {
+		if err = r.Scan(&i); err != nil {
+			break
+		}
+		l = append(l, i)
+	}
+	r.Close()
+	return l, err
+}
+func (w *Watcher) notify(x context.Context, m chan<- message, s string) {
+	r, err := w.sql.QueryContext(x, "user_role", roleAdmin)
+	if err != nil {
+		w.log.Error("Error getting Telegram admin list from database: %s!", err.Error())
+		return
+	}
+	var (
+		l []int64
+		i int64
+	)
+	for r.Next() {
+		if err = r.Scan(&i); err != nil {
+			w.log.Error("Error scanning data into Telegram admin list from database: %s!", err.Error())
+			break
+		}
+		l = append(l, i)
+	}
+	r.Close()
+	for _, v := range l {
+		select {
+		case m <- message{tries: 2, chat: v, msg: telegram.NewMessage(v, s)}:
+		case <-x.Done():
+			return
+		}
+	}
+}
+func (w *Watcher) announce(x context.Context, i int64, s string, o *telegram.MessageConfig) string {
+	l, err := w.chats(x)
+	if err != nil {
+		w.log.Error("Error getting Telegram chat list from database: %s!", err.Error())
+		return errmsg
+	}
+	if len(l) == 0 {
+		return "There are currently no chats to send an announcement to."
+	}
+	if !w.setState(x, i, stateBroadcast, s) {
+		return errmsg
+	}
+	o.ReplyMarkup = keyboard(stateBroadcast, true)
+	return "This announcement will be sent to " + strconv.Itoa(len(l)) + " chats:\n\n" + s + "\n\nDo you want to send it?"
+}
+func (w *Watcher) broadcast(x context.Context, s string) (int, error) {
+	l, err := w.chats(x)
+	if err != nil || len(l) == 0 {
+		return 0, err
+	}
+	w.log.Info("Sending broadcast message to %d chats..", len(l))
+	w.jobs.Add(1)
+	// NOTE(dij): Broadcasts are sent from their own thread instead of the
+	//            message queue, so a large broadcast can't fill it up. Each
+	//            send waits for the last one to finish, including retries.
+	go func() {
+		for i := range l {
+			select {
+			case <-time.After(spread):
+			case <-x.Done():
+				goto done
+			}
+			w.deliver(x, message{tries: 2, chat: l[i], msg: telegram.NewMessage(l[i], s)})
+		}
+		w.log.Info("Broadcast message was sent to %d chats.", len(l))
+	done:
+		w.jobs.Done()
+	}()
+	return len(l), nil
+}
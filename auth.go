@@ -0,0 +1,250 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PurpleSec/logx"
+)
+
+// renew is the minimum time between refreshing the Twitter credentials after
+// an authorization error, so a bad key does not flood the token endpoint.
+const renew = time.Minute
+
+type token struct {
+	_     [0]func()
+	Type  string `json:"token_type"`
+	Token string `json:"access_token"`
+}
+
+// account is a set of Twitter credentials. It fulfils the Authorizer interface
+// and signs requests with OAuth 1.0a when user context keys are set, otherwise
+// the app-only bearer token is used. The filtered stream endpoints only accept
+// the bearer token.
+type account struct {
+	lock   sync.RWMutex
+	log    logx.Log
+	last   time.Time
+	file   string
+	key    string
+	pass   string
+	bearer string
+	token  string
+	secret string
+	client *http.Client
+	index  int
+	static bool
+}
+type refresher struct {
+	a *account
+	s *status
+	t http.RoundTripper
+}
+type pair struct {
+	k, v string
+}
+
+func escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+func (a *account) ready() bool {
+	a.lock.RLock()
+	r := len(a.bearer) > 0 || len(a.token) > 0
+	a.lock.RUnlock()
+	return r
+}
+
+// Add fulfils the Authorizer interface.
+func (a *account) Add(r *http.Request) {
+	a.lock.RLock()
+	if len(a.token) > 0 && !strings.HasPrefix(r.URL.Path, "/2/tweets/search/stream") {
+		a.sign(r)
+	} else if len(a.bearer) > 0 {
+		r.Header.Set("Authorization", "Bearer "+a.bearer)
+	}
+	a.lock.RUnlock()
+}
+func (a *account) sign(r *http.Request) {
+	var n [16]byte
+	rand.Read(n[:])
+	o := []pair{
+		{"oauth_consumer_key", a.key},
+		{"oauth_nonce", hex.EncodeToString(n[:])},
+		{"oauth_signature_method", "HMAC-SHA1"},
+		{"oauth_timestamp", strconv.FormatInt(time.Now().Unix(), 10)},
+		{"oauth_token", a.token},
+		{"oauth_version", "1.0"},
+	}
+	l := make([]pair, 0, len(o)+4)
+	for k, v := range r.URL.Query() {
+		for i := range v {
+			l = append(l, pair{escape(k), escape(v[i])})
+		}
+	}
+	for i := range o {
+		l = append(l, pair{escape(o[i].k), escape(o[i].v)})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].k == l[j].k {
+			return l[i].v < l[j].v
+		}
+		return l[i].k < l[j].k
+	})
+	b := builders.Get().(*strings.Builder)
+	for i := range l {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(l[i].k + "=" + l[i].v)
+	}
+	var (
+		u = strings.ToLower(r.URL.Scheme) + "://" + strings.ToLower(r.URL.Host) + r.URL.EscapedPath()
+		h = hmac.New(sha1.New, []byte(escape(a.pass)+"&"+escape(a.secret)))
+	)
+	h.Write([]byte(strings.ToUpper(r.Method) + "&" + escape(u) + "&" + escape(b.String())))
+	b.Reset()
+	o = append(o, pair{"oauth_signature", base64.StdEncoding.EncodeToString(h.Sum(nil))})
+	b.WriteString("OAuth ")
+	for i := range o {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(escape(o[i].k) + `="` + escape(o[i].v) + `"`)
+	}
+	r.Header.Set("Authorization", b.String())
+	b.Reset()
+	builders.Put(b)
+}
+func (a *account) login(x context.Context) error {
+	a.lock.Lock()
+	err := a.fetch(x)
+	a.lock.Unlock()
+	return err
+}
+func (a *account) fetch(x context.Context) error {
+	if a.static {
+		return nil
+	}
+	if len(a.key) == 0 || len(a.pass) == 0 {
+		return errors.New("missing Twitter consumer key or secret")
+	}
+	r, _ := http.NewRequestWithContext(x, "POST", "https://api.twitter.com/oauth2/token", strings.NewReader("grant_type=client_credentials"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
+	r.SetBasicAuth(a.key, a.pass)
+	o, err := a.client.Do(r)
+	if err != nil {
+		return err
+	}
+	var i token
+	if err = json.NewDecoder(o.Body).Decode(&i); err == nil && o.StatusCode != http.StatusOK {
+		err = errors.New(`bearer token request returned "` + o.Status + `"`)
+	}
+	if o.Body.Close(); err != nil {
+		return err
+	}
+	if len(i.Token) == 0 {
+		return errors.New("bearer token request returned an empty token")
+	}
+	a.bearer = i.Token
+	return nil
+}
+func (a *account) load(v *keys) {
+	a.key, a.pass = v.ConsumerKey, v.ConsumerSecret
+	a.token, a.secret = v.AccessToken, v.AccessSecret
+	if a.static = len(v.Bearer) > 0; a.static {
+		a.bearer = v.Bearer
+	}
+}
+
+// refresh re-reads the Twitter credentials from the config file and fetches a
+// new bearer token. This returns false if it was done too recently.
+func (a *account) refresh(x context.Context) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if time.Since(a.last) < renew {
+		return false
+	}
+	a.last = time.Now()
+	a.log.Warning("Twitter returned an authorization error, refreshing credentials..")
+	if len(a.file) > 0 {
+		var c config
+		if b, err := os.ReadFile(a.file); err != nil {
+			a.log.Error("Error reading config file %q: %s!", a.file, err.Error())
+		} else if err = json.Unmarshal(b, &c); err != nil {
+			a.log.Error("Error parsing config file %q: %s!", a.file, err.Error())
+		} else if err = c.check(); err != nil {
+			a.log.Error("Error in config file %q: %s!", a.file, err.Error())
+		} else if a.index == 0 {
+			a.load(&c.Twitter.keys)
+		} else if a.index <= len(c.Twitter.Accounts) {
+			a.load(&c.Twitter.Accounts[a.index-1])
+		}
+	}
+	if err := a.fetch(x); err != nil {
+		a.log.Error("Error refreshing Twitter bearer token: %s!", err.Error())
+		return false
+	}
+	return true
+}
+
+// RoundTrip fulfils the http.RoundTripper interface.
+//
+// Requests that return a 401 are retried once after refreshing the credentials.
+// The Twitter stream body is wrapped so any data read from it, including the
+// keep-alives, counts as a heartbeat.
+func (r *refresher) RoundTrip(q *http.Request) (*http.Response, error) {
+	o, err := r.do(q)
+	if err == nil && r.s != nil && q.URL.Path == "/2/tweets/search/stream" {
+		o.Body = &pulser{ReadCloser: o.Body, s: r.s}
+	}
+	return o, err
+}
+func (r *refresher) do(q *http.Request) (*http.Response, error) {
+	o, err := r.t.RoundTrip(q)
+	if err != nil || o.StatusCode != http.StatusUnauthorized || (q.Body != nil && q.GetBody == nil) {
+		return o, err
+	}
+	if !r.a.refresh(q.Context()) {
+		return o, nil
+	}
+	n := q.Clone(q.Context())
+	if q.GetBody != nil {
+		if n.Body, err = q.GetBody(); err != nil {
+			return o, nil
+		}
+	}
+	o.Body.Close()
+	n.Header.Del("Authorization")
+	r.a.Add(n)
+	return r.t.RoundTrip(n)
+}
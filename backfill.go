@@ -0,0 +1,193 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+)
+
+type missed struct {
+	name string
+	id   string
+	last string
+}
+
+func (w *Watcher) backfill(x context.Context, s *shard, o chan<- post, k rules) {
+	if w.window <= 0 || len(k) == 0 || !atomic.CompareAndSwapInt32(&s.filling, 0, 1) {
+		return
+	}
+	var f map[string]struct{}
+	if len(w.shards) > 1 {
+		// NOTE(dij): Only backfill the users streamed by this shard, the
+		//            others did not disconnect.
+		f = make(map[string]struct{})
+		for _, v := range k {
+			for i := range v {
+				f[v[i]] = struct{}{}
+			}
+		}
+	}
+	// NOTE(dij): Read the last seen Tweets now, before the stream delivers any
+	//            new ones, as those move them past the Tweets that were missed.
+	l := w.missing(x, "backfill", f)
+	if len(l) == 0 {
+		atomic.StoreInt32(&s.filling, 0)
+		return
+	}
+	w.jobs.Add(1)
+	go func() {
+		w.fill(x, s, o, l)
+		atomic.StoreInt32(&s.filling, 0)
+		w.jobs.Done()
+	}()
+}
+func (w *Watcher) poll(x context.Context, s *shard, o chan<- post, v []string) {
+	if len(v) == 0 || !atomic.CompareAndSwapInt32(&s.polling, 0, 1) {
+		return
+	}
+	f := make(map[string]struct{}, len(v))
+	for i := range v {
+		f[v[i]] = struct{}{}
+	}
+	w.jobs.Add(1)
+	go func() {
+		if l := w.missing(x, "poll", f); len(l) > 0 {
+			w.log.Debug("Polling %d Twitter users that did not fit in the stream rules..", len(l))
+			// NOTE(dij): Look back twice the interval in case the last poll
+			//            ran late, the duplicate check drops any repeats.
+			w.timeline(x, s, o, l, time.Now().Add(-w.every*2), false)
+		}
+		atomic.StoreInt32(&s.polling, 0)
+		w.jobs.Done()
+	}()
+}
+func (w *Watcher) fill(x context.Context, s *shard, o chan<- post, l []missed) {
+	w.log.Info("Starting Twitter backfill task for %d users..", len(l))
+	c := w.timeline(x, s, o, l, time.Now().Add(-w.window), true)
+	w.log.Info("Completed Twitter backfill task, found %d missed Tweets.", c)
+}
+func (w *Watcher) missing(x context.Context, q string, f map[string]struct{}) []missed {
+	r, err := w.sql.QueryContext(x, q)
+	if err != nil {
+		w.log.Error("Error getting Twitter mappings from database: %s!", err.Error())
+		return nil
+	}
+	var (
+		l    []missed
+		n    string
+		i, v uint64
+	)
+	for r.Next() {
+		if err = r.Scan(&i, &n, &v); err != nil {
+			w.log.Error("Error scanning data into Twitter mappings from database: %s!", err.Error())
+			continue
+		}
+		e := missed{name: n, id: strconv.FormatUint(i, 10)}
+		if f != nil {
+			if _, ok := f[e.id]; !ok {
+				continue
+			}
+		}
+		if v > 0 {
+			e.last = strconv.FormatUint(v, 10)
+		}
+		l = append(l, e)
+	}
+	r.Close()
+	return l
+}
+func (w *Watcher) timeline(x context.Context, a *shard, o chan<- post, l []missed, s time.Time, late bool) int {
+	var (
+		c int
+		e bool
+		t = time.NewTicker(spread)
+	)
+	for z := range l {
+		if e {
+			break
+		}
+		select {
+		case <-t.C:
+		case <-x.Done():
+			t.Stop()
+			return c
+		}
+		// NOTE(dij): Only the first page is requested, 100 Tweets in the
+		//            window should be plenty for a single user.
+		q, err := a.api.UserTweetTimeline(x, l[z].id, twitter.UserTweetTimelineOpts{
+			Excludes:   []twitter.Exclude{twitter.ExcludeReplies, twitter.ExcludeRetweets},
+			SinceID:    l[z].last,
+			StartTime:  s,
+			MaxResults: 100,
+			TweetFields: []twitter.TweetField{
+				twitter.TweetFieldID,
+				twitter.TweetFieldText,
+				twitter.TweetFieldAuthorID,
+				twitter.TweetFieldInReplyToUserID,
+				twitter.TweetFieldReferencedTweets,
+				twitter.TweetFieldCreatedAt,
+			},
+		})
+		if err != nil {
+			// NOTE(dij): The timeline limit is shared by every user, so stop
+			//            here and leave the rest for the next poll.
+			if f, u := failure(err); f == failLimit {
+				w.with(fields{"account": a.id}).Warning("Twitter timelines are rate limited until %s, skipping %d users!", u.Format(time.RFC1123), len(l)-z)
+				break
+			}
+			w.with(fields{"author": l[z].name}).Error("Error retrieving Tweets for %q from Twitter: %s!", l[z].name, err.Error())
+			continue
+		}
+		if e = q.RateLimit != nil && q.RateLimit.Remaining == 0 && z+1 < len(l); e {
+			w.with(fields{"account": a.id}).Warning("Twitter timelines are rate limited until %s, skipping %d users!", q.RateLimit.Reset.Time().Format(time.RFC1123), len(l)-z-1)
+		}
+		if q.Raw == nil || len(q.Raw.Tweets) == 0 {
+			continue
+		}
+		// NOTE(dij): The timeline is newest first, so go backwards to keep
+		//            the Tweets in order.
+		for k := len(q.Raw.Tweets) - 1; k >= 0; k-- {
+			v := q.Raw.Tweets[k]
+			if v == nil || len(v.Text) == 0 || isReply(v) {
+				continue
+			}
+			// NOTE(dij): Twitter ignores the start time when the since ID is
+			//            set, so the window is checked here.
+			if d, err := time.Parse(time.RFC3339, v.CreatedAt); err == nil && d.Before(s) {
+				continue
+			}
+			if len(v.AuthorID) == 0 {
+				v.AuthorID = l[z].id
+			}
+			v.Source, v.Text = l[z].name, parseTweetText(v, q.Raw)
+			select {
+			case o <- post{TweetObj: v, late: late}:
+				c++
+			case <-x.Done():
+				t.Stop()
+				return c
+			}
+		}
+	}
+	t.Stop()
+	return c
+}
@@ -0,0 +1,159 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+)
+
+const (
+	failNetwork uint8 = iota
+	failHTTP
+	failLimit
+)
+const (
+	breakerClosed int32 = iota
+	breakerOpen
+	breakerHalf
+)
+
+// trip is the amount of failed Twitter stream connections in a row before the
+// circuit breaker opens and waits for the cool down before trying again.
+const trip = 5
+
+// cool is the time the circuit breaker stays open before a single connection is
+// tried again.
+const cool = time.Minute * 10
+
+// silence is the amount of time without a keep-alive before the Twitter stream
+// is considered dead and reconnected. Twitter sends a keep-alive every 20s.
+const silence = time.Second * 30
+
+// backoff tracks failed Twitter stream connections. Each kind of failure backs
+// off using the strategy documented by Twitter:
+//
+//   - Network errors back off linearly by 250ms, up to 16s.
+//   - HTTP errors back off exponentially from 5s, up to 320s.
+//   - Rate limit (429) errors back off exponentially from 1m, up to 16m.
+//
+// A random jitter of up to half the wait is removed to spread out reconnects.
+type backoff struct {
+	n     [3]uint
+	fails int
+}
+
+func breakerName(v int32) string {
+	switch v {
+	case breakerOpen:
+		return "open"
+	case breakerHalf:
+		return "half-open"
+	}
+	return "closed"
+}
+func failure(err error) (uint8, time.Time) {
+	var (
+		e *twitter.ErrorResponse
+		h *twitter.HTTPError
+		c int
+		r *twitter.RateLimit
+	)
+	switch {
+	case errors.As(err, &e):
+		c, r = e.StatusCode, e.RateLimit
+	case errors.As(err, &h):
+		c, r = h.StatusCode, h.RateLimit
+	default:
+		return failNetwork, time.Time{}
+	}
+	if c != 429 {
+		return failHTTP, time.Time{}
+	}
+	if r != nil && r.Reset > 0 {
+		return failLimit, r.Reset.Time()
+	}
+	return failLimit, time.Time{}
+}
+func disconnect(d *twitter.DisconnectionError) uint8 {
+	if d == nil {
+		return failNetwork
+	}
+	for _, v := range d.Disconnections {
+		if v != nil && strings.Contains(v.Title+v.DisconnectType, "TooManyConnections") {
+			return failLimit
+		}
+	}
+	return failHTTP
+}
+func (b *backoff) reset() {
+	b.n, b.fails = [3]uint{}, 0
+}
+func (b *backoff) next(k uint8, u time.Time) time.Duration {
+	if b.fails++; b.n[k] < 64 {
+		b.n[k]++
+	}
+	var d time.Duration
+	switch k {
+	case failNetwork:
+		d = time.Duration(b.n[k]) * time.Millisecond * 250
+	case failHTTP:
+		if d = time.Second * 320; b.n[k] < 7 {
+			d = (time.Second * 5) << (b.n[k] - 1)
+		}
+	default:
+		if d = time.Minute * 16; b.n[k] < 5 {
+			d = time.Minute << (b.n[k] - 1)
+		}
+	}
+	if d -= time.Duration(rand.Int63n(int64(d/2) + 1)); !u.IsZero() {
+		// NOTE(dij): Never retry before the rate limit window resets.
+		if v := time.Until(u); v > d {
+			d = v
+		}
+	}
+	return d
+}
+func (w *Watcher) retry(s *shard, b *backoff, k uint8, u time.Time) time.Duration {
+	var (
+		d = b.next(k, u)
+		l = w.with(fields{"account": s.id})
+	)
+	if k == failLimit {
+		// NOTE(dij): Rate limits are per account, so move the users to the other
+		//            accounts if there are any.
+		w.mark(s, false)
+	}
+	if b.fails < trip {
+		l.Info("Waiting %s before reconnecting the Twitter stream (attempt %d)..", d.String(), b.fails)
+		return d
+	}
+	if d < cool {
+		d = cool
+	}
+	if w.mark(s, false); atomic.SwapInt32(&s.breaker, breakerOpen) != breakerOpen {
+		l.Error("Twitter stream circuit breaker is open after %d failed connections, waiting %s!", b.fails, d.String())
+	} else {
+		l.Warning("Twitter stream circuit breaker is still open, waiting %s..", d.String())
+	}
+	return d
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffNext(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		kind uint8
+		want []time.Duration
+	}{
+		{"network", failNetwork, []time.Duration{
+			time.Millisecond * 250, time.Millisecond * 500, time.Millisecond * 750, time.Second,
+		}},
+		{"http", failHTTP, []time.Duration{
+			time.Second * 5, time.Second * 10, time.Second * 20, time.Second * 40, time.Second * 80,
+			time.Second * 160, time.Second * 320, time.Second * 320,
+		}},
+		{"limit", failLimit, []time.Duration{
+			time.Minute, time.Minute * 2, time.Minute * 4, time.Minute * 8, time.Minute * 16, time.Minute * 16,
+		}},
+	} {
+		var b backoff
+		for i, e := range v.want {
+			if d := b.next(v.kind, time.Time{}); d < e/2 || d > e {
+				t.Errorf("%s: attempt %d waited %s, want between %s and %s", v.name, i+1, d, e/2, e)
+			}
+		}
+		if b.fails != len(v.want) {
+			t.Errorf("%s: counted %d failures, want %d", v.name, b.fails, len(v.want))
+		}
+	}
+}
+func TestBackoffLimits(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		kind uint8
+		max  time.Duration
+	}{
+		{"network", failNetwork, time.Second * 16},
+		{"http", failHTTP, time.Second * 320},
+		{"limit", failLimit, time.Minute * 16},
+	} {
+		var (
+			b backoff
+			d time.Duration
+		)
+		for i := 0; i < 100; i++ {
+			if d = b.next(v.kind, time.Time{}); d > v.max {
+				t.Fatalf("%s: attempt %d waited %s, over the %s limit", v.name, i+1, d, v.max)
+			}
+		}
+		if d < v.max/2 {
+			t.Errorf("%s: waited %s after 100 attempts, want at least %s", v.name, d, v.max/2)
+		}
+	}
+}
+func TestBackoffSeparate(t *testing.T) {
+	// NOTE(dij): Each kind of failure backs off on its own, but all of them
+	//            count towards the circuit breaker until reset.
+	var b backoff
+	for i := 0; i < 5; i++ {
+		b.next(failHTTP, time.Time{})
+	}
+	if d := b.next(failNetwork, time.Time{}); d > time.Millisecond*250 {
+		t.Errorf("network backoff after HTTP failures waited %s, want at most %s", d, time.Millisecond*250)
+	}
+	if b.fails != 6 {
+		t.Errorf("counted %d failures, want 6", b.fails)
+	}
+	if b.reset(); b.fails != 0 {
+		t.Errorf("counted %d failures after reset, want 0", b.fails)
+	}
+	if d := b.next(failHTTP, time.Time{}); d > time.Second*5 {
+		t.Errorf("HTTP backoff after reset waited %s, want at most %s", d, time.Second*5)
+	}
+}
+func TestBackoffReset(t *testing.T) {
+	// NOTE(dij): A rate limit reset time is waited for even when it is longer
+	//            than the backoff.
+	var (
+		b backoff
+		u = time.Now().Add(time.Minute * 5)
+	)
+	if d := b.next(failLimit, u); d < time.Minute*4 || d > time.Minute*5 {
+		t.Errorf("rate limit backoff waited %s, want about %s", d, time.Minute*5)
+	}
+	if d := b.next(failLimit, time.Now().Add(-time.Minute)); d > time.Minute*2 {
+		t.Errorf("rate limit backoff with a past reset waited %s, want at most %s", d, time.Minute*2)
+	}
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"strconv"
 
 	"github.com/PurpleSec/watcher"
 )
@@ -37,13 +38,16 @@ Usage:
   -d              Dump the default configuration and exit.
   -clear-all      Clear the database of ALL DATA before starting up.
   -update         Update the database schema to the latest version.
+  -broadcast <m>  Send an announcement to all chats once started.
+  -dry-run        Print the amount of chats a broadcast would be sent to and exit.
 `
 
 func main() {
 	var (
 		args                     = flag.NewFlagSet("Twitter Watcher Telegram Bot "+version+"_"+buildVersion, flag.ExitOnError)
-		file                     string
+		file, notice             string
 		dump, empty, update, ver bool
+		dry                      bool
 	)
 	args.Usage = func() {
 		os.Stderr.WriteString(usage)
@@ -54,6 +58,8 @@ func main() {
 	args.BoolVar(&ver, "V", false, "")
 	args.BoolVar(&empty, "clear-all", false, "")
 	args.BoolVar(&update, "update", false, "")
+	args.StringVar(&notice, "broadcast", "", "")
+	args.BoolVar(&dry, "dry-run", false, "")
 
 	if err := args.Parse(os.Args[1:]); err != nil {
 		os.Stderr.WriteString(usage)
@@ -81,6 +87,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(notice) > 0 {
+		n, err := w.Broadcast(notice, dry)
+		if err != nil {
+			os.Stdout.WriteString("Error: " + err.Error() + "!\n")
+			os.Exit(1)
+		}
+		if dry {
+			os.Stdout.WriteString("Broadcast would be sent to " + strconv.Itoa(n) + " chats.\n")
+			os.Exit(0)
+		}
+	}
+
 	if err := w.Run(); err != nil {
 		os.Stdout.WriteString("Error: " + err.Error() + "!\n")
 		os.Exit(1)
@@ -40,18 +40,38 @@ const Defaults = `{
 	},
 	"log": {
 		"file": "watcher.log",
-		"level": 2
+		"level": 2,
+		"format": "text"
 	},
+	"admins": [],
 	"blocked": [],
 	"allowed": [],
+	"private": false,
+	"listen": "",
 	"twitter": {
 		"consumer_key": "",
-		"consumer_secret": ""
+		"consumer_secret": "",
+		"bearer_token": "",
+		"access_token": "",
+		"access_secret": "",
+		"accounts": [],
+		"tier": "elevated",
+		"rules": 0,
+		"rule_length": 0
+	},
+	"limits": {
+		"keywords": 256,
+		"mappings": 0,
+		"subscriptions": 0
 	},
 	"timeouts": {
 		"backoff": 5000000000,
 		"resolve": 21600000000000,
-		"database": 180000000000
+		"database": 180000000000,
+		"history": 604800000000000,
+		"backfill": 3600000000000,
+		"poll": 300000000000,
+		"conversation": 600000000000
 	},
 	"telegram_key": ""
 }
@@ -66,14 +86,48 @@ Please try again later.`
 Please use a command from the following list:
 /list
 /clear
-/add <@username1,@usernameN,..> [keyword1,keywordN,..]
-/remove <@username1,@usernameN,..|clear|all>`
+/cancel
+/add <@username1,@usernameN,id:12345,..> [keyword1,keywordN,..]
+/remove <@username1,@usernameN,..|clear|all>
+/keywords <@username>
+/pause [@username1,@usernameN,..|all] [duration]
+/resume [@username1,@usernameN,..|all]
+/export [json|csv]
+/import
+/import_following <@username>
+/import_list <list id>
+/why <tweet url>`
+	updated = "Awesome! Your following list was updated!"
+)
+
+var (
+	errQuotaChat  = errors.New("chat subscription quota reached")
+	errQuotaTotal = errors.New("total mapping quota reached")
+	errLookup     = errors.New("no Twitter account is available for user lookups")
 )
 
+type limits struct {
+	Keywords      int `json:"keywords"`
+	Mappings      int `json:"mappings"`
+	Subscriptions int `json:"subscriptions"`
+}
+type tier struct {
+	Rules  int `json:"rules"`
+	Length int `json:"rule_length"`
+}
+type keys struct {
+	ConsumerKey    string `json:"consumer_key"`
+	ConsumerSecret string `json:"consumer_secret"`
+	Bearer         string `json:"bearer_token"`
+	AccessToken    string `json:"access_token"`
+	AccessSecret   string `json:"access_secret"`
+}
 type config struct {
 	Twitter struct {
-		ConsumerKey    string `json:"consumer_key"`
-		ConsumerSecret string `json:"consumer_secret"`
+		keys
+		Tier     string `json:"tier"`
+		Accounts []keys `json:"accounts"`
+		tier
 	} `json:"twitter"`
 	Database struct {
 		Name     string `json:"database"`
@@ -82,21 +136,30 @@ type config struct {
 		Password string `json:"password"`
 	} `json:"db"`
 	Telegram string   `json:"telegram_key"`
+	Admins   []int64  `json:"admins"`
 	Blocked  []string `json:"blocked"`
 	Allowed  []string `json:"allowed"`
+	Private  bool     `json:"private"`
+	Listen   string   `json:"listen"`
 	Log      struct {
-		File  string `json:"file"`
-		Level int    `json:"level"`
+		File   string `json:"file"`
+		Level  int    `json:"level"`
+		Format string `json:"format"`
 	} `json:"log"`
+	Limits   limits `json:"limits"`
 	Timeouts struct {
-		Resolve  time.Duration `json:"resolver"`
-		Backoff  time.Duration `json:"backoff"`
-		Database time.Duration `json:"database"`
+		Resolve      time.Duration `json:"resolver"`
+		Backoff      time.Duration `json:"backoff"`
+		Database     time.Duration `json:"database"`
+		History      time.Duration `json:"history"`
+		Backfill     time.Duration `json:"backfill"`
+		Poll         time.Duration `json:"poll"`
+		Conversation time.Duration `json:"conversation"`
 	} `json:"timeouts"`
 }
 
 func isValid(s string) bool {
-	if len(s) == 0 || s[0] != '@' || len(s) > 16 {
+	if len(s) < 2 || s[0] != '@' || len(s) > 16 {
 		return false
 	}
 	for i := range s {
@@ -116,16 +179,62 @@ func isValid(s string) bool {
 	}
 	return true
 }
-func (c *config) check() error {
-	if len(c.Twitter.ConsumerKey) == 0 {
+func isID(s string) bool {
+	if len(s) < 4 || len(s) > 23 || !strings.EqualFold(s[:3], "id:") {
+		return false
+	}
+	n, err := strconv.ParseUint(s[3:], 10, 64)
+	return err == nil && n > 0
+}
+func (k *keys) check() error {
+	if len(k.ConsumerKey) == 0 && (len(k.Bearer) == 0 || len(k.AccessToken) > 0) {
 		return errors.New("missing Twitter consumer key")
 	}
-	if len(c.Twitter.ConsumerSecret) == 0 {
+	if len(k.ConsumerSecret) == 0 && (len(k.Bearer) == 0 || len(k.AccessToken) > 0) {
 		return errors.New("missing Twitter consumer secret")
 	}
+	if (len(k.AccessToken) == 0) != (len(k.AccessSecret) == 0) {
+		return errors.New("Twitter access token and access secret must both be set")
+	}
+	return nil
+}
+func (c *config) check() error {
+	if err := c.Twitter.keys.check(); err != nil {
+		return err
+	}
+	for i := range c.Twitter.Accounts {
+		if err := c.Twitter.Accounts[i].check(); err != nil {
+			return errors.New("Twitter account " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+	var t tier
+	switch strings.ToLower(c.Twitter.Tier) {
+	case "essential":
+		t = tier{Rules: 5, Length: 512}
+	case "", "elevated":
+		t = tier{Rules: 25, Length: 512}
+	case "academic":
+		t = tier{Rules: 1000, Length: 1024}
+	default:
+		return errors.New(`invalid Twitter tier "` + c.Twitter.Tier + `", must be "essential", "elevated" or "academic"`)
+	}
+	if c.Twitter.Rules < 0 || c.Twitter.Length < 0 || (c.Twitter.Length > 0 && c.Twitter.Length < 64) {
+		return errors.New("invalid Twitter rule limits, must not be negative and rules must be at least 64 characters")
+	}
+	if c.Twitter.Rules == 0 {
+		c.Twitter.Rules = t.Rules
+	}
+	if c.Twitter.Length == 0 {
+		c.Twitter.Length = t.Length
+	}
 	if c.Log.Level > int(logx.Fatal) || c.Log.Level < int(logx.Trace) {
 		return errors.New(`invalid log level "` + strconv.Itoa(c.Log.Level) + `"`)
 	}
+	switch strings.ToLower(c.Log.Format) {
+	case "", "text", "json":
+	default:
+		return errors.New(`invalid log format "` + c.Log.Format + `", must be "text" or "json"`)
+	}
 	if len(c.Database.Name) == 0 {
 		return errors.New("missing database name")
 	}
@@ -135,6 +244,15 @@ func (c *config) check() error {
 	if len(c.Database.Username) == 0 {
 		return errors.New("missing database username")
 	}
+	if c.Limits.Keywords > 256 || c.Limits.Keywords < 0 {
+		return errors.New(`invalid keyword limit "` + strconv.Itoa(c.Limits.Keywords) + `", must be between 1 and 256`)
+	}
+	if c.Limits.Keywords == 0 {
+		c.Limits.Keywords = 256
+	}
+	if c.Limits.Mappings < 0 || c.Limits.Subscriptions < 0 {
+		return errors.New("invalid subscription limits, must not be negative")
+	}
 	if c.Timeouts.Resolve == 0 {
 		c.Timeouts.Resolve = time.Hour * 6
 	}
@@ -144,6 +262,18 @@ func (c *config) check() error {
 	if c.Timeouts.Database == 0 {
 		c.Timeouts.Database = time.Minute * 3
 	}
+	if c.Timeouts.History == 0 {
+		c.Timeouts.History = time.Hour * 24 * 7
+	}
+	if c.Timeouts.Backfill == 0 {
+		c.Timeouts.Backfill = time.Hour
+	}
+	if c.Timeouts.Poll <= 0 {
+		c.Timeouts.Poll = time.Minute * 5
+	}
+	if c.Timeouts.Conversation == 0 {
+		c.Timeouts.Conversation = time.Minute * 10
+	}
 	return nil
 }
 func stringLowMatch(s, m string) bool {
@@ -161,33 +291,28 @@ func stringLowMatch(s, m string) bool {
 	}
 	return true
 }
-func canUseACL(n string, a, d []string) bool {
-	if len(d) == 0 && len(a) == 0 {
-		return true
-	}
-	if len(d) > 0 {
-		for i := range d {
-			if stringLowMatch(n, d[i]) {
-				return false
-			}
-		}
+func canUseACL(n string, a, d []string) uint8 {
+	if len(n) == 0 {
+		return roleNone
 	}
-	if len(a) == 0 {
-		return true
+	for i := range d {
+		if stringLowMatch(n, d[i]) {
+			return roleBanned
+		}
 	}
 	for i := range a {
 		if stringLowMatch(n, a[i]) {
-			return true
+			return roleUser
 		}
 	}
-	return false
+	return roleNone
 }
-func stringSplitContainsNLA(s, m string) bool {
+func stringSplitContainsNLA(s, m string) (bool, string) {
 	if len(s) == 0 {
-		return false
+		return false, "the Tweet has no text"
 	}
 	if len(m) == 0 {
-		return true
+		return true, "there are no keywords"
 	}
 	// NOTE(dij): This is to see if we have a valid minus char '-' next to a
 	//            comma as this indicates that we need to validate it.
@@ -202,7 +327,10 @@ func stringSplitContainsNLA(s, m string) bool {
 		//            negative look-ahead valid value).
 		n = strings.IndexByte(m[n+1:], '-')
 	}
-	var r bool
+	var (
+		r bool
+		k string
+	)
 	for i, e, o := 0, strings.IndexByte(m, ','), n > -1; i < len(m); i, e = e+1, strings.IndexByte(m[e+1:], ',') {
 		if e == -1 {
 			// NOTE(dij): Last (or only) entry.
@@ -212,7 +340,7 @@ func stringSplitContainsNLA(s, m string) bool {
 					// NOTE(dij): If i == 0, the we're the only, we can rely
 					//            on this being true.
 					if i == 0 {
-						return true
+						return true, `it does not contain the excluded keyword "` + m[i+1:] + `"`
 					}
 					// NOTE(dij): Rely on r to determine if we match.
 					break
@@ -224,12 +352,18 @@ func stringSplitContainsNLA(s, m string) bool {
 			}
 			// NOTE(dij): Only one here, since it's the last value, non-negative.
 			//            means everything else /must/ have passed
-			return strings.Contains(s, m[i:])
+			if strings.Contains(s, m[i:]) {
+				return true, `it contains the keyword "` + m[i:] + `"`
+			}
+			if m[i] == '-' && i+1 < len(m) {
+				return false, `it contains the excluded keyword "` + m[i+1:] + `"`
+			}
+			return false, `it does not contain the keyword "` + m[i:] + `"`
 		}
 		if e += i; m[i] == '-' && i+1 < e {
 			// NOTE(dij): Negative in list, if fails, we bail!
 			if strings.Contains(s, m[i+1:e]) {
-				return false
+				return false, `it contains the excluded keyword "` + m[i+1:e] + `"`
 			}
 			// NOTE(dij): Passed, continue..
 			continue
@@ -246,14 +380,37 @@ func stringSplitContainsNLA(s, m string) bool {
 			if o {
 				// NOTE(dij): If negative is enabled, we set r to true, then
 				//            continue.
-				r = true
+				r, k = true, m[i:e]
 				continue
 			}
 			// NOTE(dij): No negative, we just bail true.
-			return true
+			return true, `it contains the keyword "` + m[i:e] + `"`
 		}
 	}
-	return r
+	if r {
+		return true, `it contains the keyword "` + k + `"`
+	}
+	return false, "it does not contain any of the keywords"
+}
+func parseDuration(s string) (time.Duration, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	var m time.Duration
+	switch s[len(s)-1] {
+	case 'd', 'D':
+		m = time.Hour * 24
+	case 'w', 'W':
+		m = time.Hour * 24 * 7
+	default:
+		d, err := time.ParseDuration(s)
+		return d, err == nil && d > 0
+	}
+	n, err := strconv.ParseUint(s[:len(s)-1], 10, 16)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	return time.Duration(n) * m, true
 }
 func split(s string) ([]string, string, string) {
 	var (
@@ -267,17 +424,23 @@ func split(s string) ([]string, string, string) {
 	}
 	for i, e := 0, strings.IndexByte(v, ','); i < len(v); i, e = e+1, strings.IndexByte(v[e+1:], ',') {
 		if e == -1 {
-			if t = strings.TrimSpace(v[i:]); !isValid(t) {
-				return nil, k, `The username "` + t + `" is not a valid Twitter username!` + "\n\nTwitter names must start with \"@\" and contain no special characters or spaces."
-			}
-			r = append(r, t[1:])
-			break
+			e = len(v)
+		} else {
+			e += i
 		}
-		e += i
-		if t = strings.TrimSpace(v[i:e]); !isValid(t) {
+		// NOTE(dij): Account IDs are kept with their "id:" prefix, so they can
+		//            be told apart from usernames.
+		switch t = strings.TrimSpace(v[i:e]); {
+		case isID(t):
+			r = append(r, "id:"+t[3:])
+		case isValid(t):
+			r = append(r, t[1:])
+		default:
 			return nil, k, `The username "` + t + `" is not a valid Twitter username!` + "\n\nTwitter names must start with \"@\" and contain no special characters or spaces."
 		}
-		r = append(r, t[1:])
+		if e == len(v) {
+			break
+		}
 	}
 	if len(k) == 0 {
 		return r, "", ""
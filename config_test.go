@@ -0,0 +1,84 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsID(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		want bool
+	}{
+		{"", false},
+		{"1", false},
+		{"id:", false},
+		{"id:0", false},
+		{"id:-1", false},
+		{"id:abc", false},
+		{"@id:1", false},
+		{"id:1", true},
+		{"ID:12345", true},
+		{"id:18446744073709551615", true},
+		{"id:18446744073709551616", false},
+	} {
+		if r := isID(v.name); r != v.want {
+			t.Errorf("isID(%q) = %t, want %t", v.name, r, v.want)
+		}
+	}
+}
+func TestSplit(t *testing.T) {
+	for _, v := range []struct {
+		in    string
+		users []string
+		words string
+		fail  bool
+	}{
+		{"@user", []string{"user"}, "", false},
+		{"@user,@other_1", []string{"user", "other_1"}, "", false},
+		{"@user,", []string{"user"}, "", false},
+		{"id:42", []string{"id:42"}, "", false},
+		{"ID:42", []string{"id:42"}, "", false},
+		{"@user,id:42", []string{"user", "id:42"}, "", false},
+		{"id:42 cats & dogs", []string{"id:42"}, "cats &amp; dogs", false},
+		{"@user  cats, dogs ", []string{"user"}, "cats, dogs", false},
+		{"@user, @other", []string{"user"}, "@other", false},
+		{"@", nil, "", true},
+		{"user", nil, "", true},
+		{"@user,,@other", nil, "", true},
+		{"@user,id:0", nil, "", true},
+		{"id:abc", nil, "", true},
+		{"@user!", nil, "", true},
+	} {
+		r, k, m := split(v.in)
+		if v.fail {
+			if len(m) == 0 {
+				t.Errorf("split(%q) = %q, %q, want an error", v.in, r, k)
+			}
+			continue
+		}
+		if len(m) > 0 {
+			t.Errorf("split(%q) returned the error %q", v.in, m)
+			continue
+		}
+		if !reflect.DeepEqual(r, v.users) || k != v.words {
+			t.Errorf("split(%q) = %q, %q, want %q, %q", v.in, r, k, v.users, v.words)
+		}
+	}
+}
@@ -19,35 +19,160 @@ package watcher
 var cleanStatements = []string{
 	`DROP TABLES IF EXISTS Subscribers`,
 	`DROP TABLES IF EXISTS Mappings`,
+	`DROP TABLES IF EXISTS Conversations`,
+	`DROP TABLES IF EXISTS Quotas`,
+	`DROP TABLES IF EXISTS Redemptions`,
+	`DROP TABLES IF EXISTS Invites`,
+	`DROP TABLES IF EXISTS Users`,
+	`DROP TABLES IF EXISTS Statistics`,
+	`DROP TABLES IF EXISTS Audit`,
+	`DROP TABLES IF EXISTS Deliveries`,
+	`DROP TABLES IF EXISTS Renames`,
+	`DROP TABLES IF EXISTS Posts`,
 	`DROP PROCEDURE IF EXISTS UpdateMapping`,
 	`DROP PROCEDURE IF EXISTS CleanupRoutine`,
 	`DROP PROCEDURE IF EXISTS AddSubscription`,
+	`DROP PROCEDURE IF EXISTS AddSubscriptionID`,
 	`DROP PROCEDURE IF EXISTS RemoveSubscription`,
 	`DROP PROCEDURE IF EXISTS GetAllSubscriptions`,
 	`DROP PROCEDURE IF EXISTS RemoveAllSubscriptions`,
+	`DROP PROCEDURE IF EXISTS RedeemInvite`,
 }
 var upgradeStatements = []string{
 	`DROP PROCEDURE IF EXISTS CleanupRoutine`,
 	`DROP PROCEDURE IF EXISTS AddSubscription`,
-	`ALTER TABLE Subscribers ADD Keywords VARCHAR(256) NULL AFTER Mapping`,
+	`DROP PROCEDURE IF EXISTS UpdateMapping`,
+	`DROP PROCEDURE IF EXISTS RemoveSubscription`,
+	`DROP PROCEDURE IF EXISTS RemoveAllSubscriptions`,
+	`ALTER TABLE Subscribers ADD COLUMN IF NOT EXISTS Keywords VARCHAR(256) NULL AFTER Mapping`,
+	`ALTER TABLE Subscribers ADD COLUMN IF NOT EXISTS Paused DATETIME NULL AFTER Keywords`,
+	`ALTER TABLE IF EXISTS Conversations MODIFY Payload TEXT NULL`,
+	`ALTER TABLE Mappings ADD COLUMN IF NOT EXISTS Last BIGINT(64) UNSIGNED NOT NULL DEFAULT 0 AFTER Twitter`,
+	`ALTER TABLE Mappings ADD COLUMN IF NOT EXISTS Status TINYINT(8) UNSIGNED NOT NULL DEFAULT 0 AFTER Last`,
+	`DROP PROCEDURE IF EXISTS GetAllSubscriptions`,
+	`ALTER TABLE Mappings DROP INDEX IF EXISTS Name`,
+	`CREATE INDEX IF NOT EXISTS MappingName ON Mappings(Name)`,
+	`CREATE INDEX IF NOT EXISTS MappingTwitter ON Mappings(Twitter)`,
 }
 
 var setupStatements = []string{
 	`CREATE TABLE IF NOT EXISTS Mappings(
 		ID BIGINT(64) NOT NULL PRIMARY KEY AUTO_INCREMENT,
-		Name VARCHAR(20) NOT NULL UNIQUE,
-		Twitter BIGINT(64) NOT NULL DEFAULT 0
+		Name VARCHAR(20) NOT NULL,
+		Twitter BIGINT(64) NOT NULL DEFAULT 0,
+		Last BIGINT(64) UNSIGNED NOT NULL DEFAULT 0,
+		Status TINYINT(8) UNSIGNED NOT NULL DEFAULT 0,
+		INDEX MappingName(Name),
+		INDEX MappingTwitter(Twitter)
 	)`,
 	`CREATE TABLE IF NOT EXISTS Subscribers(
 		ID BIGINT(64) NOT NULL PRIMARY KEY AUTO_INCREMENT,
 		Chat BIGINT(64) NOT NULL,
 		Mapping BIGINT(64) NOT NULL,
 		Keywords VARCHAR(256) NULL,
+		Paused DATETIME NULL,
 		FOREIGN KEY(Mapping) REFERENCES Mappings(ID)
 	)`,
+	`CREATE TABLE IF NOT EXISTS Conversations(
+		Chat BIGINT(64) NOT NULL PRIMARY KEY,
+		Action TINYINT(8) UNSIGNED NOT NULL DEFAULT 0,
+		Payload TEXT NULL,
+		Expires DATETIME NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS Quotas(
+		User BIGINT(64) NOT NULL PRIMARY KEY,
+		Keywords INT NULL,
+		Subscriptions INT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS Users(
+		ID BIGINT(64) NOT NULL PRIMARY KEY,
+		Name VARCHAR(64) NULL,
+		Role TINYINT(8) UNSIGNED NOT NULL DEFAULT 0,
+		Updated DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS Invites(
+		Code VARCHAR(32) NOT NULL PRIMARY KEY,
+		Creator BIGINT(64) NOT NULL,
+		Uses INT NOT NULL DEFAULT 0,
+		MaxUses INT NOT NULL DEFAULT 1,
+		Expires DATETIME NULL,
+		Created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS Redemptions(
+		ID BIGINT(64) NOT NULL PRIMARY KEY AUTO_INCREMENT,
+		Code VARCHAR(32) NOT NULL,
+		User BIGINT(64) NOT NULL,
+		Time DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(Code) REFERENCES Invites(Code) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS Statistics(
+		Day DATE NOT NULL PRIMARY KEY,
+		Received BIGINT(64) UNSIGNED NOT NULL DEFAULT 0,
+		Delivered BIGINT(64) UNSIGNED NOT NULL DEFAULT 0,
+		Filtered BIGINT(64) UNSIGNED NOT NULL DEFAULT 0,
+		Failed BIGINT(64) UNSIGNED NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS Audit(
+		ID BIGINT(64) NOT NULL PRIMARY KEY AUTO_INCREMENT,
+		Time DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		Actor BIGINT(64) NOT NULL DEFAULT 0,
+		Chat BIGINT(64) NOT NULL DEFAULT 0,
+		Action VARCHAR(16) NOT NULL,
+		Name VARCHAR(20) NULL,
+		Old VARCHAR(256) NULL,
+		New VARCHAR(256) NULL,
+		INDEX(Chat),
+		INDEX(Name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS Deliveries(
+		ID BIGINT(64) NOT NULL PRIMARY KEY AUTO_INCREMENT,
+		Time DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		Chat BIGINT(64) NOT NULL,
+		Post BIGINT(64) UNSIGNED NOT NULL,
+		Author VARCHAR(20) NOT NULL,
+		Status TINYINT(8) UNSIGNED NOT NULL DEFAULT 0,
+		Reason VARCHAR(320) NULL,
+		INDEX(Chat, Post),
+		INDEX(Time)
+	)`,
+	`CREATE TABLE IF NOT EXISTS Posts(
+		Chat BIGINT(64) NOT NULL,
+		Post BIGINT(64) UNSIGNED NOT NULL,
+		Time DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(Chat, Post),
+		INDEX(Time)
+	)`,
+	`CREATE TABLE IF NOT EXISTS Renames(
+		ID BIGINT(64) NOT NULL PRIMARY KEY AUTO_INCREMENT,
+		Time DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		Twitter BIGINT(64) NOT NULL,
+		Old VARCHAR(20) NOT NULL,
+		New VARCHAR(20) NOT NULL,
+		INDEX(Twitter)
+	)`,
+	`CREATE PROCEDURE IF NOT EXISTS RedeemInvite(InviteCode VARCHAR(32), UserID BIGINT(64))
+	BEGIN
+		START TRANSACTION;
+			SET @valid = COALESCE((
+				SELECT 1 FROM Invites I WHERE I.Code = InviteCode AND I.Uses < I.MaxUses AND (I.Expires IS NULL OR I.Expires > NOW())
+				LIMIT 1 FOR UPDATE
+			), 0);
+			IF @valid = 1 THEN
+				UPDATE Invites SET Uses = Uses + 1 WHERE Code = InviteCode;
+				INSERT INTO Redemptions(Code, User) VALUES(InviteCode, UserID);
+				INSERT INTO Users(ID, Role) VALUES(UserID, 2) ON DUPLICATE KEY UPDATE Role = IF(Role = 0, 2, Role);
+			END IF;
+		COMMIT;
+		SELECT @valid;
+	END;`,
 	`CREATE PROCEDURE IF NOT EXISTS CleanupRoutine()
 	BEGIN
 		START TRANSACTION;
+			INSERT INTO Audit(Chat, Action, Name, Old)
+				SELECT S.Chat, "duplicate", M.Name, S.Keywords FROM Subscribers S INNER JOIN Mappings M ON M.ID = S.Mapping WHERE
+					(SELECT MIN(Y.ID) FROM Subscribers Y WHERE Y.Chat = S.Chat AND Y.Mapping = S.Mapping) <> S.ID;
+			INSERT INTO Audit(Action, Name)
+				SELECT "unused", M.Name FROM Mappings M WHERE (SELECT COUNT(S.ID) FROM Subscribers S WHERE S.Mapping = M.ID) = 0;
 			DELETE FROM Subscribers WHERE ID In (
 				SELECT * FROM (
 					SELECT S.ID FROM Subscribers S WHERE
@@ -60,46 +185,82 @@ var setupStatements = []string{
 					SELECT M.ID FROM Mappings M WHERE (SELECT COUNT(S.ID) FROM Subscribers S WHERE S.Mapping = M.ID) = 0
 				) As Unused
 			);
+			DELETE FROM Conversations WHERE Expires <= NOW();
 		COMMIT;
 	END;`,
 	`CREATE PROCEDURE IF NOT EXISTS GetAllSubscriptions()
 	BEGIN
 		CALL CleanupRoutine();
-		SELECT (SELECT COUNT(ID) FROM Mappings) As Amount, ID, Name, Twitter FROM Mappings;
+		SELECT (SELECT COUNT(ID) FROM Mappings) As Amount, ID, Name, Twitter, Status FROM Mappings;
 	END;`,
-	`CREATE PROCEDURE IF NOT EXISTS RemoveAllSubscriptions(ChatID BIGINT(64))
+	`CREATE PROCEDURE IF NOT EXISTS RemoveAllSubscriptions(ChatID BIGINT(64), Actor BIGINT(64))
 	BEGIN
 		START TRANSACTION;
+			INSERT INTO Audit(Actor, Chat, Action, Name, Old)
+				SELECT Actor, ChatID, "clear", M.Name, S.Keywords FROM Subscribers S INNER JOIN Mappings M ON M.ID = S.Mapping WHERE S.Chat = ChatID;
 			DELETE FROM Subscribers WHERE Chat = ChatID;
 			CALL CleanupRoutine();
 		COMMIT;
 	END;`,
-	`CREATE PROCEDURE IF NOT EXISTS AddSubscription(ChatID BIGINT(64), Name VARCHAR(20), Keyword VARCHAR(256))
+	`CREATE PROCEDURE IF NOT EXISTS AddSubscription(ChatID BIGINT(64), Name VARCHAR(20), Keyword VARCHAR(256), Actor BIGINT(64))
 	BEGIN
 		SET @exists = COALESCE(
-			(SELECT M.ID FROM Mappings M INNER JOIN Subscribers S ON S.Mapping = M.ID WHERE M.Name = Name AND S.Chat = ChatID LIMIT 1), 0
+			(SELECT M.ID FROM Mappings M INNER JOIN Subscribers S ON S.Mapping = M.ID WHERE M.Name = Name AND S.Chat = ChatID
+				ORDER BY M.Status >= 3, M.Twitter = 0 LIMIT 1), 0
 		);
 		IF @exists = 0 THEN
-			SET @mid = COALESCE((SELECT M.ID FROM Mappings M WHERE M.Name = Name LIMIT 1), 0);
+			SET @mid = COALESCE((SELECT M.ID FROM Mappings M WHERE M.Name = Name ORDER BY M.Status >= 3, M.Twitter = 0 LIMIT 1), 0);
 			START TRANSACTION;
 				IF @mid = 0 THEN
 					INSERT INTO Mappings(Name) VALUES(Name);
-					SET @mid = (SELECT M.ID FROM Mappings M WHERE M.Name = Name LIMIT 1);
+					SET @mid = LAST_INSERT_ID();
 				END IF;
 				INSERT INTO Subscribers(Mapping, Chat, Keywords) VALUES(@mid, ChatID, Keyword);
+				INSERT INTO Audit(Actor, Chat, Action, Name, New) VALUES(Actor, ChatID, "add", Name, Keyword);
 			COMMIT;
 		ELSE
-			UPDATE Subscribers SET Keywords=Keyword WHERE Chat = ChatID AND Mapping = @exists;
+			SET @old = (SELECT S.Keywords FROM Subscribers S WHERE S.Chat = ChatID AND S.Mapping = @exists LIMIT 1);
+			START TRANSACTION;
+				UPDATE Subscribers SET Keywords=Keyword WHERE Chat = ChatID AND Mapping = @exists;
+				IF NOT (@old <=> Keyword) THEN
+					INSERT INTO Audit(Actor, Chat, Action, Name, Old, New) VALUES(Actor, ChatID, "keywords", Name, @old, Keyword);
+				END IF;
+			COMMIT;
 		END IF;
 		SELECT M.Twitter FROM Mappings M WHERE M.ID = @mid;
 	END;`,
-	`CREATE PROCEDURE IF NOT EXISTS RemoveSubscription(ChatID BIGINT(64), Name VARCHAR(20))
+	`CREATE PROCEDURE IF NOT EXISTS AddSubscriptionID(ChatID BIGINT(64), TwitterID BIGINT(64), Name VARCHAR(20), Keyword VARCHAR(256), Actor BIGINT(64))
 	BEGIN
-		SET @mid = COALESCE(
-			(SELECT M.ID FROM Mappings M INNER JOIN Subscribers S ON S.Mapping = M.ID WHERE M.Name = Name AND S.Chat = ChatID LIMIT 1), 0
-		);
+		SET @mid = COALESCE((SELECT M.ID FROM Mappings M WHERE M.Twitter = TwitterID LIMIT 1), 0);
+		SET @exists = COALESCE((SELECT S.Mapping FROM Subscribers S WHERE S.Mapping = @mid AND S.Chat = ChatID LIMIT 1), 0);
+		IF @exists = 0 THEN
+			START TRANSACTION;
+				IF @mid = 0 THEN
+					INSERT INTO Mappings(Name, Twitter, Status) VALUES(Name, TwitterID, 1);
+					SET @mid = LAST_INSERT_ID();
+				END IF;
+				INSERT INTO Subscribers(Mapping, Chat, Keywords) VALUES(@mid, ChatID, Keyword);
+				INSERT INTO Audit(Actor, Chat, Action, Name, New) VALUES(Actor, ChatID, "add", Name, Keyword);
+			COMMIT;
+		ELSE
+			SET @old = (SELECT S.Keywords FROM Subscribers S WHERE S.Chat = ChatID AND S.Mapping = @exists LIMIT 1);
+			START TRANSACTION;
+				UPDATE Subscribers SET Keywords=Keyword WHERE Chat = ChatID AND Mapping = @exists;
+				IF NOT (@old <=> Keyword) THEN
+					INSERT INTO Audit(Actor, Chat, Action, Name, Old, New) VALUES(Actor, ChatID, "keywords", Name, @old, Keyword);
+				END IF;
+			COMMIT;
+		END IF;
+		SELECT M.Twitter FROM Mappings M WHERE M.ID = @mid;
+	END;`,
+	`CREATE PROCEDURE IF NOT EXISTS RemoveSubscription(ChatID BIGINT(64), MapID BIGINT(64), Actor BIGINT(64))
+	BEGIN
+		SET @mid = COALESCE((SELECT S.Mapping FROM Subscribers S WHERE S.Mapping = MapID AND S.Chat = ChatID LIMIT 1), 0);
 		IF @mid > 0 THEN
 			START TRANSACTION;
+				INSERT INTO Audit(Actor, Chat, Action, Name, Old)
+					SELECT Actor, ChatID, "remove", M.Name, S.Keywords FROM Subscribers S INNER JOIN Mappings M ON M.ID = S.Mapping
+					WHERE S.Mapping = @mid AND S.Chat = ChatID LIMIT 1;
 				DELETE FROM Subscribers WHERE Mapping = @mid AND Chat = ChatID;
 			COMMIT;
 			SET @mid_count = COALESCE((SELECT COUNT(S.Mapping) FROM Subscribers S WHERE S.Mapping = @mid), 0);
@@ -112,22 +273,17 @@ var setupStatements = []string{
 	END;`,
 	`CREATE PROCEDURE IF NOT EXISTS UpdateMapping(MapID BIGINT(64), TwitterID BIGINT(64), Name VARCHAR(20))
 	BEGIN
-		SET @count = COALESCE((SELECT COUNT(M.ID) FROM Mappings M WHERE M.Twitter = TwitterID), 0);
-		SET @exists = COALESCE((SELECT M.ID FROM Mappings M WHERE M.ID = MapID AND M.Name = Name LIMIT 1), 0);
-		IF @exists = 0 THEN
-			IF @count > 1 THEN
-				START TRANSACTION;
-					INSERT INTO Mappings(Name, Twitter) VALUES(CONCAT("!", Name), TwitterID);
-					SET @mid = (SELECT M.ID FROM Mappings M WHERE M.Twitter = TwitterID AND M.Name = CONCAT("!", Name) LIMIT 1);
-					UPDATE Subscribers S INNER JOIN Mappings M ON M.ID = S.Mapping SET S.Mapping = @mid WHERE M.Twitter = TwitterID;
-					DELETE FROM Mappings WHERE Twitter = TwitterID AND ID != @mid;
-					UPDATE Mappings SET Name = Name WHERE ID = @mid;
-				COMMIT;
-			ELSE
-				START TRANSACTION;
-					UPDATE Mappings M SET M.Twitter = TwitterID, M.Name = Name WHERE M.ID = MapID;
-				COMMIT;
-			END IF;
+		SET @other = COALESCE((SELECT M.ID FROM Mappings M WHERE M.Twitter = TwitterID AND M.ID <> MapID LIMIT 1), 0);
+		INSERT INTO Audit(Chat, Action, Name, Old, New)
+			SELECT S.Chat, "rename", Name, M.Name, Name FROM Subscribers S INNER JOIN Mappings M ON M.ID = S.Mapping
+			WHERE (M.ID = MapID OR M.Twitter = TwitterID) AND M.Name <> Name;
+		INSERT INTO Renames(Twitter, Old, New)
+			SELECT TwitterID, M.Name, Name FROM Mappings M WHERE M.ID = MapID AND M.Twitter = TwitterID AND TwitterID > 0 AND M.Name <> Name;
+		IF TwitterID > 0 AND @other > 0 THEN
+			START TRANSACTION;
+				UPDATE Subscribers SET Mapping = @other WHERE Mapping = MapID;
+				UPDATE Mappings M SET M.Name = Name WHERE M.ID = @other;
+			COMMIT;
 		ELSE
 			START TRANSACTION;
 				UPDATE Mappings M SET M.Twitter = TwitterID, M.Name = Name WHERE M.ID = MapID;
@@ -138,12 +294,65 @@ var setupStatements = []string{
 }
 
 var queryStatements = map[string]string{
-	"add":      `CALL AddSubscription(?, ?, ?)`,
-	"del":      `CALL RemoveSubscription(?, ?)`,
-	"set":      `CALL UpdateMapping(?, ?, ?)`,
-	"list":     `SELECT M.Name, M.Twitter, S.Keywords FROM Mappings M INNER JOIN Subscribers S ON S.Mapping = M.ID WHERE S.Chat = ?`,
-	"notify":   `SELECT S.Chat, S.Keywords FROM Subscribers S INNER JOIN Mappings M ON M.ID = S.Mapping WHERE M.Twitter = ?`,
-	"del_all":  `CALL RemoveAllSubscriptions(?)`,
-	"get_all":  `CALL GetAllSubscriptions()`,
-	"get_list": `SELECT (SELECT COUNT(ID) FROM Mappings) As Count, Twitter FROM Mappings`,
+	"add":    `CALL AddSubscription(?, ?, ?, ?)`,
+	"add_id": `CALL AddSubscriptionID(?, ?, ?, ?, ?)`,
+	"del":    `CALL RemoveSubscription(?, ?, ?)`,
+	"set":    `CALL UpdateMapping(?, ?, ?)`,
+	"list": `SELECT M.Name, M.Twitter, M.Status, S.Keywords, TIMESTAMPDIFF(SECOND, NOW(), S.Paused) FROM Mappings M
+		INNER JOIN Subscribers S ON S.Mapping = M.ID WHERE S.Chat = ?`,
+	"notify": `SELECT S.Chat, S.Keywords FROM Subscribers S INNER JOIN Mappings M ON M.ID = S.Mapping
+		WHERE M.Twitter = ? AND (S.Paused IS NULL OR S.Paused <= NOW())`,
+	"pause": `UPDATE Subscribers
+		SET Paused = COALESCE(DATE_ADD(NOW(), INTERVAL ? SECOND), '9999-12-31 23:59:59') WHERE Chat = ? AND Mapping = ?`,
+	"pause_all": `UPDATE Subscribers SET Paused = COALESCE(DATE_ADD(NOW(), INTERVAL ? SECOND), '9999-12-31 23:59:59') WHERE Chat = ?`,
+	"resume":    `UPDATE Subscribers SET Paused = NULL WHERE Chat = ? AND Mapping = ?`,
+	"quota": `SELECT (SELECT COUNT(ID) FROM Subscribers WHERE Chat = ?), (SELECT COUNT(ID) FROM Mappings),
+		(SELECT COUNT(S.ID) FROM Subscribers S INNER JOIN Mappings M ON M.ID = S.Mapping WHERE S.Chat = ? AND IF(? > 0, M.Twitter = ?, M.Name = ?)),
+		(SELECT COUNT(ID) FROM Mappings WHERE IF(? > 0, Twitter = ?, Name = ?))`,
+	"quota_get": `SELECT Subscriptions, Keywords FROM Quotas WHERE User = ?`,
+	"quota_set": `INSERT INTO Quotas(User, Subscriptions, Keywords) VALUES(?, ?, ?)
+		ON DUPLICATE KEY UPDATE Subscriptions = VALUES(Subscriptions), Keywords = VALUES(Keywords)`,
+	"user_get":   `SELECT Role FROM Users WHERE ID = ?`,
+	"user_set":   `INSERT INTO Users(ID, Role) VALUES(?, ?) ON DUPLICATE KEY UPDATE Role = VALUES(Role)`,
+	"user_find":  `SELECT ID FROM Users WHERE Name = ? ORDER BY Updated DESC LIMIT 1`,
+	"user_list":  `SELECT ID, Name, Role FROM Users WHERE Role > 0 ORDER BY Role DESC, Name`,
+	"user_role":  `SELECT ID FROM Users WHERE Role = ?`,
+	"user_seen":  `INSERT INTO Users(ID, Name) VALUES(?, ?) ON DUPLICATE KEY UPDATE Name = VALUES(Name)`,
+	"invite_add": `INSERT INTO Invites(Code, Creator, MaxUses, Expires) VALUES(?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))`,
+	"invite_use": `CALL RedeemInvite(?, ?)`,
+	"chats":      `SELECT DISTINCT Chat FROM Subscribers`,
+	"stats": `SELECT (SELECT COUNT(DISTINCT Chat) FROM Subscribers), (SELECT COUNT(ID) FROM Mappings),
+		(SELECT COUNT(ID) FROM Mappings WHERE Twitter = 0 AND Status = 0), (SELECT COUNT(ID) FROM Mappings WHERE Status > 2)`,
+	"stats_add": `INSERT INTO Statistics(Day, Received, Delivered, Filtered, Failed) VALUES(CURDATE(), ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE Received = Received + VALUES(Received), Delivered = Delivered + VALUES(Delivered),
+		Filtered = Filtered + VALUES(Filtered), Failed = Failed + VALUES(Failed)`,
+	"stats_days": `SELECT Day, Received, Delivered, Filtered, Failed FROM Statistics ORDER BY Day DESC LIMIT 7`,
+	"audit": `SELECT Time, Actor, Chat, Action, Name, Old, New FROM Audit
+		WHERE (? = 0 OR Chat = ?) AND (? = '' OR Name = ?) ORDER BY ID DESC LIMIT ?`,
+	"history_add":   `INSERT INTO Deliveries(Chat, Post, Author, Status, Reason) VALUES(?, ?, ?, ?, ?)`,
+	"history_set":   `UPDATE Deliveries SET Status = ? WHERE Chat = ? AND Post = ?`,
+	"history_get":   `SELECT Time, Author, Status, Reason FROM Deliveries WHERE Chat = ? AND Post = ? ORDER BY ID DESC LIMIT 1`,
+	"history_prune": `DELETE FROM Deliveries WHERE Time < DATE_SUB(NOW(), INTERVAL ? SECOND)`,
+	"history_sub": `SELECT M.Name, S.Keywords, TIMESTAMPDIFF(SECOND, NOW(), S.Paused) FROM Subscribers S
+		INNER JOIN Mappings M ON M.ID = S.Mapping WHERE S.Chat = ? AND M.Twitter = ?`,
+	"seen":        `UPDATE Mappings SET Last = ? WHERE Twitter = ? AND Last < ?`,
+	"poll":        `SELECT Twitter, Name, Last FROM Mappings WHERE Twitter > 0 AND Status < 3`,
+	"backfill":    `SELECT Twitter, Name, Last FROM Mappings WHERE Twitter > 0 AND Status < 3`,
+	"export":      `SELECT M.Name, M.Twitter, S.Keywords FROM Mappings M INNER JOIN Subscribers S ON S.Mapping = M.ID WHERE S.Chat = ? ORDER BY M.Name`,
+	"resume_all":  `UPDATE Subscribers SET Paused = NULL WHERE Chat = ?`,
+	"del_all":     `CALL RemoveAllSubscriptions(?, ?)`,
+	"get_all":     `CALL GetAllSubscriptions()`,
+	"get_list":    `SELECT (SELECT COUNT(ID) FROM Mappings) As Count, Twitter FROM Mappings WHERE Status < 3`,
+	"status":      `UPDATE Mappings SET Status = ? WHERE ID = ?`,
+	"subscribers": `SELECT Chat FROM Subscribers WHERE Mapping = ?`,
+	"state_get":   `SELECT Action, Payload FROM Conversations WHERE Chat = ? AND Expires > NOW()`,
+	"state_set": `INSERT INTO Conversations(Chat, Action, Payload, Expires) VALUES(?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))
+		ON DUPLICATE KEY UPDATE Action = VALUES(Action), Payload = VALUES(Payload), Expires = VALUES(Expires)`,
+	"state_del":       `DELETE FROM Conversations WHERE Chat = ?`,
+	"post_add":        `INSERT IGNORE INTO Posts(Chat, Post) VALUES(?, ?)`,
+	"post_prune":      `DELETE FROM Posts WHERE Time < DATE_SUB(NOW(), INTERVAL ? SECOND)`,
+	"subscribers_tid": `SELECT DISTINCT S.Chat FROM Subscribers S INNER JOIN Mappings M ON M.ID = S.Mapping WHERE M.Twitter = ?`,
+	"renames":         `SELECT Old FROM Renames WHERE Twitter = ? ORDER BY ID DESC LIMIT 5`,
+	"sub_find": `SELECT M.ID, M.Name FROM Mappings M INNER JOIN Subscribers S ON S.Mapping = M.ID
+		WHERE S.Chat = ? AND IF(? > 0, M.Twitter = ?, M.Name = ?) ORDER BY M.Status >= 3, M.Twitter = 0 LIMIT 1`,
 }
@@ -0,0 +1,87 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// recent is the amount of Tweet IDs kept in memory to detect duplicates.
+const recent = 4096
+
+type lru struct {
+	lock  sync.Mutex
+	order *list.List
+	items map[uint64]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{order: list.New(), items: make(map[uint64]*list.Element, recent)}
+}
+
+// has returns true if the ID is in the cache.
+func (l *lru) has(i uint64) bool {
+	l.lock.Lock()
+	_, ok := l.items[i]
+	l.lock.Unlock()
+	return ok
+}
+
+// add returns false if the ID was already in the cache, otherwise the ID is
+// added and the oldest entry is removed if the cache is full.
+func (l *lru) add(i uint64) bool {
+	l.lock.Lock()
+	if e, ok := l.items[i]; ok {
+		l.order.MoveToFront(e)
+		l.lock.Unlock()
+		return false
+	}
+	l.items[i] = l.order.PushFront(i)
+	if l.order.Len() > recent {
+		e := l.order.Back()
+		l.order.Remove(e)
+		delete(l.items, e.Value.(uint64))
+	}
+	l.lock.Unlock()
+	return true
+}
+
+// claim returns true the first time the Tweet is handled for the chat. This is
+// kept in the database, so each chat only gets a Tweet once, even across
+// a restart.
+func (w *Watcher) claim(x context.Context, c int64, i uint64) bool {
+	r, err := w.sql.ExecContext(x, "post_add", c, i)
+	if err != nil {
+		w.with(fields{"chat_id": c}).Error("Error adding seen Tweet %d to database: %s!", i, err.Error())
+		return true
+	}
+	n, _ := r.RowsAffected()
+	return n > 0
+}
+
+// handled marks the Tweet as handled for every chat, once it was given to all
+// of them. Repeats are then dropped by the cache without a database lookup.
+func (w *Watcher) handled(x context.Context, a int64, i uint64) {
+	w.seen.add(i)
+	// NOTE(dij): Last is only the cursor used by backfill and polling. Late
+	//            Tweets arrive after newer ones, so it never decides duplicates.
+	if _, err := w.sql.ExecContext(x, "seen", i, a, i); err != nil {
+		w.log.Error("Error updating last seen Tweet for %d in database: %s!", a, err.Error())
+	}
+}
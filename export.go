@@ -0,0 +1,411 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	maxFile   = 1 << 20
+	maxErrors = 20
+	maxImport = 1000
+)
+
+type entry struct {
+	User     string `json:"user"`
+	ID       string `json:"id,omitempty"`
+	Keywords string `json:"keywords,omitempty"`
+}
+
+func (w *Watcher) export(x context.Context, i int64, s string, m chan<- message) string {
+	var j bool
+	switch strings.ToLower(s) {
+	case "", "json":
+		j = true
+	case "csv":
+	default:
+		return `I'm sorry, but I can only export your list as "json" or "csv".`
+	}
+	r, err := w.sql.QueryContext(x, "export", i)
+	if err != nil {
+		w.log.Error("Error getting Twitter subscription list from database: %s!", err.Error())
+		return errmsg
+	}
+	var (
+		l []entry
+		n string
+		t int64
+		k sql.NullString
+	)
+	for r.Next() {
+		if err = r.Scan(&n, &t, &k); err != nil {
+			w.log.Error("Error scanning data into Twitter subscriptions list from database: %s!", err.Error())
+			continue
+		}
+		if len(n) == 0 {
+			continue
+		}
+		e := entry{User: "@" + n, Keywords: html.UnescapeString(k.String)}
+		if t > 0 {
+			e.ID = strconv.FormatInt(t, 10)
+		}
+		l = append(l, e)
+	}
+	if r.Close(); len(l) == 0 {
+		return "There are currently no users that I am following for you."
+	}
+	var (
+		b bytes.Buffer
+		f = "watcher-" + strconv.FormatInt(i, 10)
+	)
+	if j {
+		e := json.NewEncoder(&b)
+		e.SetIndent("", "    ")
+		err = e.Encode(l)
+		f += ".json"
+	} else {
+		c := csv.NewWriter(&b)
+		c.Write([]string{"user", "keywords", "id"})
+		for z := range l {
+			c.Write([]string{l[z].User, l[z].Keywords, l[z].ID})
+		}
+		c.Flush()
+		err = c.Error()
+		f += ".csv"
+	}
+	if err != nil {
+		w.log.Error("Error generating Twitter subscription export for chat %d: %s!", i, err.Error())
+		return errmsg
+	}
+	d := telegram.NewDocument(i, telegram.FileBytes{Name: f, Bytes: b.Bytes()})
+	d.Caption = "Here is your following list! Reply to me with /import and this file to load it again."
+	m <- message{tries: 2, chat: i, msg: d}
+	return ""
+}
+func (w *Watcher) download(x context.Context, d *telegram.Document) ([]byte, error) {
+	u, err := w.bot.GetFileDirectURL(d.FileID)
+	if err != nil {
+		return nil, err
+	}
+	q, err := http.NewRequestWithContext(x, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := w.bot.Client.Do(q)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxFile))
+	r.Body.Close()
+	return b, err
+}
+func (w *Watcher) load(x context.Context, i, y int64, d *telegram.Document, c chan<- uint8) string {
+	w.endState(x, i)
+	q, err := w.quota(x, y)
+	if err != nil {
+		w.log.Error("Error getting quota for user %d from database: %s!", y, err.Error())
+		return errmsg
+	}
+	if d.FileSize > maxFile {
+		return `I'm sorry, but that file is too large! Imports must be under 1MB.`
+	}
+	b, err := w.download(x, d)
+	if err != nil {
+		w.log.Error("Error downloading Telegram document %q for chat %d: %s!", d.FileID, i, err.Error())
+		return errmsg
+	}
+	var (
+		l []entry
+		o []int
+	)
+	if v := bytes.TrimSpace(b); len(v) > 0 && v[0] == '[' {
+		if err = json.Unmarshal(v, &l); err != nil {
+			return `I'm sorry, but that file does not contain a valid JSON list: ` + err.Error()
+		}
+		for z := range l {
+			o = append(o, z+1)
+		}
+	} else {
+		r := csv.NewReader(bytes.NewReader(b))
+		r.FieldsPerRecord, r.TrimLeadingSpace = -1, true
+		for {
+			v, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return `I'm sorry, but that file does not contain a valid CSV list: ` + err.Error()
+			}
+			if len(v) == 0 || (len(v[0]) == 0 && len(v) == 1) {
+				continue
+			}
+			z, _ := r.FieldPos(0)
+			if z == 1 && stringLowMatch(v[0], "user") {
+				continue
+			}
+			e := entry{User: v[0]}
+			if len(v) > 1 {
+				e.Keywords = v[1]
+			}
+			if len(v) > 2 {
+				e.ID = v[2]
+			}
+			l, o = append(l, e), append(o, z)
+		}
+	}
+	if len(l) == 0 {
+		return `I'm sorry, but that file does not contain any users to follow!`
+	}
+	var (
+		e []string
+		g []int
+		v []string
+		a int
+		u bool
+	)
+	for z := range l {
+		n := strings.TrimSpace(l[z].User)
+		if len(n) > 0 && n[0] != '@' && !isID(n) {
+			n = "@" + n
+		}
+		// NOTE(dij): Each entry is a single user, so anything that split would
+		//            read as a list or as keywords is rejected here.
+		r, k, m := split(n + " " + strings.TrimSpace(l[z].Keywords))
+		if len(m) > 0 || len(r) != 1 || strings.ContainsAny(n, " ,") {
+			e = append(e, "Line "+strconv.Itoa(o[z])+`: "`+n+`" is not a valid Twitter username or account ID.`)
+			continue
+		}
+		if len(k) > q.Keywords {
+			e = append(e, "Line "+strconv.Itoa(o[z])+": keyword lists must be under "+strconv.Itoa(q.Keywords)+" characters.")
+			continue
+		}
+		d := strings.TrimSpace(l[z].ID)
+		if l[z].User, l[z].Keywords = r[0], k; len(d) == 0 && isID(r[0]) {
+			d = r[0][3:]
+		}
+		if len(d) > 0 {
+			t, err := strconv.ParseUint(d, 10, 64)
+			if err != nil || t == 0 || t > math.MaxInt64 {
+				e = append(e, "Line "+strconv.Itoa(o[z])+`: "`+d+`" is not a valid Twitter account ID.`)
+				continue
+			}
+			l[z].ID = strconv.FormatUint(t, 10)
+			v = append(v, "id:"+l[z].ID)
+		} else {
+			l[z].ID = ""
+			v = append(v, l[z].User)
+		}
+		g = append(g, z)
+	}
+	// NOTE(dij): Exports keep the account ID, so the users are looked up by it
+	//            first, which follows any renames since the export. If Twitter
+	//            can't be reached, the exported username and ID are used as-is.
+	f, err := w.identify(x, v)
+	if err != nil {
+		w.log.Warning("Error looking up Twitter users for import, adding them as-is: %s!", err.Error())
+	}
+	for _, z := range g {
+		var (
+			n = l[z].User
+			k = strings.ToLower(n)
+			t int64
+		)
+		if len(l[z].ID) > 0 {
+			t, _ = strconv.ParseInt(l[z].ID, 10, 64)
+			k = "id:" + l[z].ID
+		}
+		if d, ok := f[k]; ok {
+			n = d.UserName
+			t, _ = strconv.ParseInt(d.ID, 10, 64)
+		} else if t > 0 && f != nil {
+			e = append(e, "Line "+strconv.Itoa(o[z])+": I couldn't find a Twitter account with the ID "+l[z].ID+".")
+			continue
+		} else if isID(n) {
+			e = append(e, "Line "+strconv.Itoa(o[z])+": I can't look up the Twitter account ID "+l[z].ID+" right now.")
+			continue
+		}
+		r, err := w.subscribe(x, i, y, n, t, sql.NullString{Valid: len(l[z].Keywords) > 0, String: l[z].Keywords}, q)
+		if v := w.limited(err, q); len(v) > 0 {
+			e = append(e, "Line "+strconv.Itoa(o[z])+": "+v)
+			break
+		}
+		if err != nil {
+			w.log.Error("Error adding Twitter subscription entry to database: %s!", err.Error())
+			e = append(e, "Line "+strconv.Itoa(o[z])+": a server error occurred, stopping the import here.")
+			break
+		}
+		u = u || r
+		a++
+	}
+	if a > 0 {
+		if u {
+			c <- 1
+		} else {
+			c <- 0
+		}
+	}
+	s := "Awesome! I have imported " + strconv.Itoa(a) + " subscriptions into your following list!"
+	if len(e) == 0 {
+		return s
+	}
+	if s += "\n\nThe following entries could not be imported:\n"; len(e) > maxErrors {
+		e = append(e[:maxErrors], "(and "+strconv.Itoa(len(e)-maxErrors)+" more)")
+	}
+	return s + strings.Join(e, "\n")
+}
+func (w *Watcher) following(x context.Context, i, y int64, s string, l bool, m chan<- message, c chan<- uint8) string {
+	if l {
+		if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+			return `I'm sorry, but "` + s + `" is not a valid Twitter list ID!`
+		}
+	} else if !isValid(s) {
+		return `The username "` + s + `" is not a valid Twitter username!` + "\n\nTwitter names must start with \"@\" and contain no special characters or spaces."
+	}
+	if !w.pick().acct.ready() {
+		return `I'm sorry, but I am not connected to Twitter right now. Please try again later.`
+	}
+	w.jobs.Add(1)
+	go func() {
+		r := w.bulk(x, i, y, s, l, c)
+		select {
+		case m <- message{tries: 2, chat: i, msg: telegram.NewMessage(i, r)}:
+		case <-x.Done():
+		}
+		w.jobs.Done()
+	}()
+	if l {
+		return "Alright, I am importing the members of that list. I will let you know once I'm done!"
+	}
+	return "Alright, I am importing the users that " + s + " follows. I will let you know once I'm done!"
+}
+func (w *Watcher) bulk(x context.Context, i, y int64, s string, l bool, c chan<- uint8) string {
+	q, err := w.quota(x, y)
+	if err != nil {
+		w.log.Error("Error getting quota for user %d from database: %s!", y, err.Error())
+		return errmsg
+	}
+	o := w.pick().api
+	if !l {
+		r, err := o.UserNameLookup(x, []string{s[1:]}, twitter.UserLookupOpts{UserFields: []twitter.UserField{twitter.UserFieldID}})
+		if err != nil {
+			w.log.Error("Error retrieving data about Twitter user %q from Twitter: %s!", s, err.Error())
+			return errmsg
+		}
+		if r.Raw == nil || len(r.Raw.Users) == 0 || r.Raw.Users[0] == nil {
+			return `I'm sorry, but I could not find the Twitter user ` + s + `!`
+		}
+		s = r.Raw.Users[0].ID
+	}
+	var (
+		t, p, f string
+		a       int
+		u, e    bool
+	)
+	for a < maxImport {
+		var (
+			v   *twitter.UserRaw
+			err error
+		)
+		if l {
+			var r *twitter.ListUserMembersResponse
+			r, err = o.ListUserMembers(x, s, twitter.ListUserMembersOpts{
+				UserFields: []twitter.UserField{twitter.UserFieldID, twitter.UserFieldUserName}, MaxResults: 100, PaginationToken: t,
+			})
+			if err == nil {
+				if v, p = r.Raw, ""; r.Meta != nil {
+					p = r.Meta.NextToken
+				}
+			}
+		} else {
+			var r *twitter.UserFollowingLookupResponse
+			r, err = o.UserFollowingLookup(x, s, twitter.UserFollowingLookupOpts{
+				UserFields: []twitter.UserField{twitter.UserFieldID, twitter.UserFieldUserName}, MaxResults: 1000, PaginationToken: t,
+			})
+			if err == nil {
+				if v, p = r.Raw, ""; r.Meta != nil {
+					p = r.Meta.NextToken
+				}
+			}
+		}
+		if err != nil {
+			w.log.Error("Error retrieving Twitter following data for %q from Twitter: %s!", s, err.Error())
+			e = true
+			break
+		}
+		if v == nil || len(v.Users) == 0 {
+			break
+		}
+		for z := 0; z < len(v.Users) && a < maxImport; z++ {
+			if v.Users[z] == nil || !isValid("@"+v.Users[z].UserName) {
+				continue
+			}
+			d, _ := strconv.ParseInt(v.Users[z].ID, 10, 64)
+			r, err := w.subscribe(x, i, y, v.Users[z].UserName, d, sql.NullString{}, q)
+			if f = w.limited(err, q); len(f) > 0 {
+				break
+			}
+			if err != nil {
+				w.log.Error("Error adding Twitter subscription entry to database: %s!", err.Error())
+				e = true
+				break
+			}
+			u = u || r
+			a++
+		}
+		if t = p; e || len(f) > 0 || len(t) == 0 {
+			break
+		}
+	}
+	if a > 0 {
+		var k uint8
+		if u {
+			k = 1
+		}
+		select {
+		case c <- k:
+		case <-x.Done():
+		}
+	}
+	r := "Awesome! I have imported " + strconv.Itoa(a) + " subscriptions into your following list!"
+	switch {
+	case e && a == 0:
+		return errmsg
+	case e:
+		return r + "\n\nI ran into an error from Twitter partway through, so some users might be missing."
+	case len(f) > 0 && a == 0:
+		return f
+	case len(f) > 0:
+		return r + "\n\n" + f
+	case a >= maxImport:
+		return r + "\n\nI stopped after " + strconv.Itoa(maxImport) + " users, as that is the most I can import at once."
+	}
+	return r
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+)
+
+const (
+	streamStopped int32 = iota
+	streamIdle
+	streamConnected
+	streamDisconnected
+)
+
+// heartbeat is how often the Twitter stream connection state is checked.
+const heartbeat = time.Second * 10
+
+// stall is the time without a heartbeat before the liveness check fails. It's
+// longer than silence, so a restart is only asked for when reconnecting the
+// stream has not fixed it.
+const stall = time.Minute * 2
+
+type status struct {
+	beat    int64
+	stream  int32
+	breaker int32
+}
+type check struct {
+	Error string `json:"error,omitempty"`
+	OK    bool   `json:"ok"`
+}
+type report struct {
+	Status   string  `json:"status"`
+	Uptime   float64 `json:"uptime"`
+	Database check   `json:"database"`
+	Telegram struct {
+		check
+		Username string `json:"username,omitempty"`
+	} `json:"telegram"`
+	Stream  feed   `json:"stream"`
+	Streams []feed `json:"streams,omitempty"`
+}
+type feed struct {
+	State     string  `json:"state"`
+	Breaker   string  `json:"breaker"`
+	Rules     int64   `json:"rules"`
+	Polled    int64   `json:"polled"`
+	Heartbeat float64 `json:"heartbeat"`
+	v         int32
+}
+
+func streamName(v int32) string {
+	switch v {
+	case streamIdle:
+		return "idle"
+	case streamConnected:
+		return "connected"
+	case streamDisconnected:
+		return "disconnected"
+	}
+	return "stopped"
+}
+
+// pulser updates the heartbeat on every read with data. The stream library
+// skips the keep-alives and blocks on a dead socket, so reads are the only
+// sign that the connection is still alive.
+type pulser struct {
+	io.ReadCloser
+	s *status
+}
+
+func (p *pulser) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	if n > 0 {
+		p.s.pulse()
+	}
+	return n, err
+}
+func (s *status) pulse() {
+	atomic.StoreInt64(&s.beat, time.Now().UnixNano())
+}
+func (s *status) set(t *twitter.TweetStream) {
+	if t == nil {
+		atomic.StoreInt32(&s.stream, streamIdle)
+	} else {
+		atomic.StoreInt32(&s.stream, streamConnected)
+	}
+	s.pulse()
+}
+func (s *shard) feed() (feed, bool) {
+	f := feed{
+		v:      atomic.LoadInt32(&s.stream),
+		Rules:  atomic.LoadInt64(&s.rules),
+		Polled: atomic.LoadInt64(&s.extra),
+	}
+	f.State, f.Breaker = streamName(f.v), breakerName(atomic.LoadInt32(&s.breaker))
+	if b := atomic.LoadInt64(&s.beat); b > 0 {
+		f.Heartbeat = time.Since(time.Unix(0, b)).Seconds()
+	}
+	switch f.v {
+	case streamIdle:
+		return f, true
+	case streamConnected:
+		return f, f.Heartbeat < silence.Seconds()
+	}
+	return f, false
+}
+func (w *Watcher) report(x context.Context) (report, bool) {
+	var r report
+	r.Uptime = time.Since(w.stats.start).Seconds()
+	if err := w.sql.Database.PingContext(x); err != nil {
+		r.Database.Error = err.Error()
+	} else {
+		r.Database.OK = true
+	}
+	if u, err := w.bot.GetMe(); err != nil {
+		r.Telegram.Error = err.Error()
+	} else {
+		r.Telegram.OK, r.Telegram.Username = true, u.UserName
+	}
+	// NOTE(dij): With more than one account, the stream is ready when any of
+	//            them are, as the users of a failed account are moved to the
+	//            others. The best one is shown as the stream state.
+	var (
+		n, m int64
+		ok   bool
+	)
+	for i, s := range w.shards {
+		f, v := s.feed()
+		if n, m = n+f.Rules, m+f.Polled; len(w.shards) > 1 {
+			r.Streams = append(r.Streams, f)
+		}
+		if i == 0 || (v && !ok) || (v == ok && f.v > r.Stream.v && f.v != streamDisconnected) {
+			r.Stream, ok = f, v
+		}
+	}
+	r.Stream.Rules, r.Stream.Polled = n, m
+	return r, ok && r.Database.OK && r.Telegram.OK
+}
+func (w *Watcher) serveHealth(o http.ResponseWriter, q *http.Request) {
+	x, f := context.WithTimeout(q.Context(), time.Second*5)
+	r, ok := w.report(x)
+	f()
+	if q.URL.Path == "/healthz" {
+		// NOTE(dij): Liveness only fails when the stream has stalled, as a
+		//            restart would not fix the database or Telegram being
+		//            unreachable.
+		if ok = true; r.Stream.v == streamConnected {
+			ok = r.Stream.Heartbeat < stall.Seconds()
+		}
+	}
+	o.Header().Set("Content-Type", "application/json")
+	if r.Status = "ok"; !ok {
+		r.Status = "unavailable"
+		o.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(o).Encode(r)
+}
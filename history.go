@@ -0,0 +1,178 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+)
+
+const (
+	deliveryFiltered uint8 = iota
+	deliveryQueued
+	deliverySent
+	deliveryFailed
+)
+
+func postID(s string) (string, bool) {
+	if i := strings.Index(s, "/status/"); i >= 0 {
+		s = s[i+8:]
+	}
+	if i := strings.IndexAny(s, "/?#"); i > 0 {
+		s = s[:i]
+	}
+	if len(s) == 0 || len(s) > 20 {
+		return "", false
+	}
+	if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+		return "", false
+	}
+	return s, true
+}
+func (w *Watcher) prune(x context.Context) {
+	if _, err := w.sql.ExecContext(x, "history_prune", int64(w.history.Seconds())); err != nil {
+		w.log.Error("Error removing expired delivery history from database: %s!", err.Error())
+	}
+	// NOTE(dij): Seen Tweets must be kept for as long as backfill or polling
+	//            can return them again.
+	d := w.history
+	if w.window > d {
+		d = w.window
+	}
+	if w.every*2 > d {
+		d = w.every * 2
+	}
+	if _, err := w.sql.ExecContext(x, "post_prune", int64(d.Seconds())); err != nil {
+		w.log.Error("Error removing expired seen Tweets from database: %s!", err.Error())
+	}
+}
+func (w *Watcher) record(x context.Context, i int64, t *twitter.TweetObj, s uint8, r string) {
+	if _, err := w.sql.ExecContext(x, "history_add", i, t.ID, t.Source, s, r); err != nil {
+		w.with(fields{"chat_id": i, "tweet_id": t.ID}).Error("Error adding delivery history to database: %s!", err.Error())
+	}
+}
+func (w *Watcher) delivered(x context.Context, i int64, p string, s uint8) {
+	if _, err := w.sql.ExecContext(x, "history_set", s, i, p); err != nil {
+		w.with(fields{"chat_id": i, "tweet_id": p}).Error("Error updating delivery history in database: %s!", err.Error())
+	}
+}
+func (w *Watcher) why(x context.Context, i int64, s string) string {
+	p, ok := postID(s)
+	if !ok {
+		return `I'm sorry, but "` + s + `" is not a valid Tweet link or ID!`
+	}
+	r, ok := w.sql.QueryRowContext(x, "history_get", i, p)
+	if !ok {
+		return errmsg
+	}
+	var (
+		t, a string
+		v    uint8
+		e    sql.NullString
+	)
+	switch err := r.Scan(&t, &a, &v, &e); err {
+	case nil:
+		switch v {
+		case deliveryFiltered:
+			return "I received this Tweet from @" + a + " at " + t + ", but I did not send it to you because " + e.String + "."
+		case deliveryQueued:
+			return "I received this Tweet from @" + a + " at " + t + " because " + e.String + ", and it is waiting to be sent to you."
+		case deliverySent:
+			return "I sent this Tweet from @" + a + " to you at " + t + " because " + e.String + "."
+		}
+		return "I received this Tweet from @" + a + " at " + t + " because " + e.String + ", but I was unable to send it to you as Telegram returned errors."
+	case sql.ErrNoRows:
+	default:
+		w.log.Error("Error getting delivery history from database: %s!", err.Error())
+		return errmsg
+	}
+	return w.explain(x, i, p)
+}
+func (w *Watcher) explain(x context.Context, i int64, p string) string {
+	a := w.pick()
+	if !a.acct.ready() {
+		return `I have no record of that Tweet, and I am not connected to Twitter right now to look it up.`
+	}
+	o, err := a.api.TweetLookup(x, []string{p}, twitter.TweetLookupOpts{
+		Expansions: []twitter.Expansion{twitter.ExpansionAuthorID},
+		UserFields: []twitter.UserField{twitter.UserFieldID, twitter.UserFieldUserName},
+		TweetFields: []twitter.TweetField{
+			twitter.TweetFieldID,
+			twitter.TweetFieldText,
+			twitter.TweetFieldAuthorID,
+			twitter.TweetFieldInReplyToUserID,
+			twitter.TweetFieldReferencedTweets,
+		},
+	})
+	if err != nil {
+		w.log.Error("Error retrieving Tweet %q from Twitter: %s!", p, err.Error())
+		return errmsg
+	}
+	if o.Raw == nil || len(o.Raw.Tweets) == 0 || o.Raw.Tweets[0] == nil {
+		return `I'm sorry, but I could not find that Tweet! It might have been deleted or be from a protected account.`
+	}
+	t := o.Raw.Tweets[0]
+	if o.Raw.Includes != nil && len(o.Raw.Includes.Users) > 0 {
+		t.Source = o.Raw.Includes.Users[0].UserName
+	}
+	u, _ := strconv.ParseInt(t.AuthorID, 10, 64)
+	r, err := w.sql.QueryContext(x, "history_sub", i, u)
+	if err != nil {
+		w.log.Error("Error getting Twitter subscriptions from database: %s!", err.Error())
+		return errmsg
+	}
+	var (
+		n string
+		k sql.NullString
+		d sql.NullInt64
+		f bool
+	)
+	if r.Next() {
+		if err = r.Scan(&n, &k, &d); err != nil {
+			w.log.Error("Error scanning data into Twitter subscriptions from database: %s!", err.Error())
+		}
+		f = true
+	}
+	if r.Close(); err != nil {
+		return errmsg
+	}
+	switch {
+	case !f:
+		return "I did not send you this Tweet because you are not following @" + t.Source + " in this chat."
+	case len(t.Text) == 0:
+		return "I did not send you this Tweet because it is empty or just an image."
+	case t.Text[0] == '@' || len(t.InReplyToUserID) > 0:
+		return "I did not send you this Tweet because it is a reply, which I skip."
+	case len(t.ReferencedTweets) > 0:
+		return "I did not send you this Tweet because it is a Retweet or a quote, which I skip."
+	case d.Valid && d.Int64 > 0:
+		return "I did not send you this Tweet because your subscription to @" + n + " is paused."
+	}
+	e := "there are no keywords"
+	if k.Valid {
+		var ok bool
+		if ok, e = stringSplitContainsNLA(strings.ToLower(parseTweetText(t, o.Raw)), k.String); !ok {
+			return "I would not send you this Tweet because " + e + "."
+		}
+	}
+	return "This Tweet matches your subscription to @" + n + " because " + e + ", but I have no record of receiving it." +
+		"\n\nIt may have been posted while I was disconnected from Twitter or before you followed @" + n + ", or the record of it has expired."
+}
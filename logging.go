@@ -0,0 +1,157 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PurpleSec/logx"
+)
+
+type fields map[string]interface{}
+type output struct {
+	sync.Mutex
+	w    io.Writer
+	l, p logx.Level
+}
+type structured struct {
+	*output
+	f fields
+}
+
+func (w *Watcher) with(f fields) logx.Log {
+	if s, ok := w.log.(*structured); ok {
+		return s.with(f)
+	}
+	return w.log
+}
+func (s *structured) with(f fields) *structured {
+	n := make(fields, len(s.f)+len(f))
+	for k, v := range s.f {
+		n[k] = v
+	}
+	for k, v := range f {
+		n[k] = v
+	}
+	return &structured{output: s.output, f: n}
+}
+func newLog(file string, format string, level int) (logx.Log, error) {
+	if !strings.EqualFold(format, "json") {
+		l := logx.Multiple(logx.Console(logx.Level(level)))
+		if len(file) > 0 {
+			f, err := logx.File(file, logx.Append, logx.Level(level))
+			if err != nil {
+				return nil, errors.New(`setting up log file "` + file + `": ` + err.Error())
+			}
+			l.Add(f)
+		}
+		return l, nil
+	}
+	o := &output{w: logx.DefaultConsole, l: logx.Level(level), p: logx.Info}
+	if len(file) > 0 {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.New(`setting up log file "` + file + `": ` + err.Error())
+		}
+		o.w = io.MultiWriter(o.w, f)
+	}
+	return &structured{output: o}, nil
+}
+
+// Log fulfils the logx.LogWriter interface.
+//
+// This writes the message and any fields as a single JSON line.
+func (s *structured) Log(l logx.Level, _ int, m string, v ...interface{}) {
+	if l < s.l {
+		return
+	}
+	s.write(l, fmt.Sprintf(m, v...))
+}
+func (s *structured) write(l logx.Level, m string) {
+	if l < s.l {
+		return
+	}
+	e := make(fields, len(s.f)+3)
+	for k, x := range s.f {
+		e[k] = x
+	}
+	e["msg"], e["time"], e["level"] = m, time.Now().Format(time.RFC3339Nano), strings.ToLower(strings.TrimSpace(l.String()))
+	b, err := json.Marshal(e)
+	if err != nil {
+		b, _ = json.Marshal(fields{"time": e["time"], "level": e["level"], "msg": m})
+	}
+	s.Lock()
+	s.w.Write(append(b, '\n'))
+	s.Unlock()
+}
+func (s *structured) SetLevel(l logx.Level) {
+	s.l = l
+}
+func (s *structured) SetPrefix(_ string) {}
+func (s *structured) SetPrintLevel(l logx.Level) {
+	s.p = l
+}
+func (s *structured) Print(v ...interface{}) {
+	s.write(s.p, fmt.Sprint(v...))
+}
+func (s *structured) Panic(v ...interface{}) {
+	m := fmt.Sprint(v...)
+	s.write(logx.Panic, m)
+	panic(m)
+}
+func (s *structured) Println(v ...interface{}) {
+	s.write(s.p, strings.TrimSpace(fmt.Sprintln(v...)))
+}
+func (s *structured) Panicln(v ...interface{}) {
+	m := fmt.Sprintln(v...)
+	s.write(logx.Panic, strings.TrimSpace(m))
+	panic(m)
+}
+func (s *structured) Info(m string, v ...interface{}) {
+	s.Log(logx.Info, 0, m, v...)
+}
+func (s *structured) Error(m string, v ...interface{}) {
+	s.Log(logx.Error, 0, m, v...)
+}
+func (s *structured) Fatal(m string, v ...interface{}) {
+	if s.Log(logx.Fatal, 0, m, v...); logx.FatalExits {
+		os.Exit(1)
+	}
+}
+func (s *structured) Trace(m string, v ...interface{}) {
+	s.Log(logx.Trace, 0, m, v...)
+}
+func (s *structured) Debug(m string, v ...interface{}) {
+	s.Log(logx.Debug, 0, m, v...)
+}
+func (s *structured) Printf(m string, v ...interface{}) {
+	s.Log(s.p, 0, m, v...)
+}
+func (s *structured) Panicf(m string, v ...interface{}) {
+	s.Log(logx.Panic, 0, m, v...)
+	panic(fmt.Sprintf(m, v...))
+}
+func (s *structured) Warning(m string, v ...interface{}) {
+	s.Log(logx.Warning, 0, m, v...)
+}
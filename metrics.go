@@ -0,0 +1,191 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PurpleSec/mapper"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type timing struct {
+	count uint64
+	total time.Duration
+}
+type metrics struct {
+	reconnects uint64
+	reloads    uint64
+	resolves   uint64
+	resolving  int64
+	dropped    uint64
+
+	lock   sync.Mutex
+	errors map[int]uint64
+}
+type database struct {
+	*mapper.Map
+	lock  sync.Mutex
+	times map[string]*timing
+}
+
+func (d *database) observe(n string, t time.Time) {
+	v := time.Since(t)
+	d.lock.Lock()
+	e, ok := d.times[n]
+	if !ok {
+		e = new(timing)
+		d.times[n] = e
+	}
+	e.count++
+	e.total += v
+	d.lock.Unlock()
+}
+func (m *metrics) sendError(err error) {
+	var (
+		e *telegram.Error
+		c int
+	)
+	if errors.As(err, &e) {
+		c = e.Code
+	}
+	m.lock.Lock()
+	m.errors[c]++
+	m.lock.Unlock()
+}
+func (m *metrics) resolved(d time.Duration) {
+	atomic.AddUint64(&m.resolves, 1)
+	atomic.AddInt64(&m.resolving, int64(d))
+}
+
+// Exec wraps the mapper 'Exec' function to record the query latency.
+func (d *database) Exec(n string, a ...interface{}) (sql.Result, error) {
+	return d.ExecContext(context.Background(), n, a...)
+}
+
+// ExecContext wraps the mapper 'ExecContext' function to record the query latency.
+func (d *database) ExecContext(x context.Context, n string, a ...interface{}) (sql.Result, error) {
+	t := time.Now()
+	r, err := d.Map.ExecContext(x, n, a...)
+	d.observe(n, t)
+	return r, err
+}
+
+// QueryContext wraps the mapper 'QueryContext' function to record the query
+// latency.
+func (d *database) QueryContext(x context.Context, n string, a ...interface{}) (*sql.Rows, error) {
+	t := time.Now()
+	r, err := d.Map.QueryContext(x, n, a...)
+	d.observe(n, t)
+	return r, err
+}
+
+// QueryRowContext wraps the mapper 'QueryRowContext' function to record the
+// query latency.
+func (d *database) QueryRowContext(x context.Context, n string, a ...interface{}) (*sql.Row, bool) {
+	t := time.Now()
+	r, ok := d.Map.QueryRowContext(x, n, a...)
+	d.observe(n, t)
+	return r, ok
+}
+func metric(b *strings.Builder, n, t, h string) {
+	b.WriteString("# HELP " + n + " " + h + "\n# TYPE " + n + " " + t + "\n")
+}
+func (w *Watcher) serveMetrics(o http.ResponseWriter, _ *http.Request) {
+	var (
+		v = w.stats.now.load()
+		b = builders.Get().(*strings.Builder)
+	)
+	metric(b, "watcher_stream_reconnects_total", "counter", "Twitter stream disconnections.")
+	b.WriteString("watcher_stream_reconnects_total " + strconv.FormatUint(atomic.LoadUint64(&w.metrics.reconnects), 10) + "\n")
+	metric(b, "watcher_stream_reloads_total", "counter", "Twitter stream rule reloads.")
+	b.WriteString("watcher_stream_reloads_total " + strconv.FormatUint(atomic.LoadUint64(&w.metrics.reloads), 10) + "\n")
+	metric(b, "watcher_stream_rules", "gauge", "Twitter stream rules in use.")
+	for _, v := range w.shards {
+		b.WriteString(`watcher_stream_rules{account="` + strconv.Itoa(v.id) + `"} ` + strconv.FormatInt(atomic.LoadInt64(&v.rules), 10) + "\n")
+	}
+	metric(b, "watcher_stream_breaker", "gauge", "Twitter stream circuit breaker state (0 closed, 1 open, 2 half-open).")
+	for _, v := range w.shards {
+		b.WriteString(`watcher_stream_breaker{account="` + strconv.Itoa(v.id) + `"} ` + strconv.FormatInt(int64(atomic.LoadInt32(&v.breaker)), 10) + "\n")
+	}
+	metric(b, "watcher_stream_overflow", "gauge", "Twitter users polled as the stream rules are full.")
+	for _, v := range w.shards {
+		b.WriteString(`watcher_stream_overflow{account="` + strconv.Itoa(v.id) + `"} ` + strconv.FormatInt(atomic.LoadInt64(&v.extra), 10) + "\n")
+	}
+	metric(b, "watcher_resolve_duration_seconds", "summary", "Twitter ID mapping resolve runs.")
+	b.WriteString(
+		"watcher_resolve_duration_seconds_sum " + strconv.FormatFloat(time.Duration(atomic.LoadInt64(&w.metrics.resolving)).Seconds(), 'f', -1, 64) +
+			"\nwatcher_resolve_duration_seconds_count " + strconv.FormatUint(atomic.LoadUint64(&w.metrics.resolves), 10) + "\n",
+	)
+	metric(b, "watcher_tweets_received_total", "counter", "Tweets received from the Twitter stream.")
+	b.WriteString("watcher_tweets_received_total " + strconv.FormatUint(v.received, 10) + "\n")
+	metric(b, "watcher_tweets_delivered_total", "counter", "Tweets delivered to Telegram chats.")
+	b.WriteString("watcher_tweets_delivered_total " + strconv.FormatUint(v.delivered, 10) + "\n")
+	metric(b, "watcher_tweets_failed_total", "counter", "Tweets that could not be delivered to Telegram chats.")
+	b.WriteString("watcher_tweets_failed_total " + strconv.FormatUint(v.failed, 10) + "\n")
+	metric(b, "watcher_tweets_filtered_total", "counter", "Tweets skipped as replies, retweets or by keywords.")
+	b.WriteString("watcher_tweets_filtered_total " + strconv.FormatUint(v.filtered, 10) + "\n")
+	metric(b, "watcher_keyword_drops_total", "counter", "Tweets not sent to a chat as they did not match the keywords.")
+	b.WriteString("watcher_keyword_drops_total " + strconv.FormatUint(atomic.LoadUint64(&w.metrics.dropped), 10) + "\n")
+	metric(b, "watcher_telegram_send_errors_total", "counter", "Telegram send errors by error code.")
+	w.metrics.lock.Lock()
+	c := make([]int, 0, len(w.metrics.errors))
+	for k := range w.metrics.errors {
+		c = append(c, k)
+	}
+	sort.Ints(c)
+	for _, k := range c {
+		b.WriteString(`watcher_telegram_send_errors_total{code="` + strconv.Itoa(k) + `"} ` + strconv.FormatUint(w.metrics.errors[k], 10) + "\n")
+	}
+	w.metrics.lock.Unlock()
+	if w.stats.depth != nil {
+		q, t, k := w.stats.depth()
+		metric(b, "watcher_queue_depth", "gauge", "Entries waiting in the internal queues.")
+		b.WriteString(
+			`watcher_queue_depth{queue="messages"} ` + strconv.Itoa(q) + "\n" + `watcher_queue_depth{queue="tweets"} ` + strconv.Itoa(t) +
+				"\n" + `watcher_queue_depth{queue="reloads"} ` + strconv.Itoa(k) + "\n",
+		)
+	}
+	metric(b, "watcher_db_query_duration_seconds", "summary", "Database query latency by query name.")
+	w.sql.lock.Lock()
+	n := make([]string, 0, len(w.sql.times))
+	for k := range w.sql.times {
+		n = append(n, k)
+	}
+	sort.Strings(n)
+	for _, k := range n {
+		b.WriteString(
+			`watcher_db_query_duration_seconds_sum{query="` + k + `"} ` + strconv.FormatFloat(w.sql.times[k].total.Seconds(), 'f', -1, 64) + "\n" +
+				`watcher_db_query_duration_seconds_count{query="` + k + `"} ` + strconv.FormatUint(w.sql.times[k].count, 10) + "\n",
+		)
+	}
+	w.sql.lock.Unlock()
+	o.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	o.Write([]byte(b.String()))
+	b.Reset()
+	builders.Put(b)
+}
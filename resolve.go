@@ -0,0 +1,409 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// NOTE(dij): Mappings with a status of mappingNotFound or higher are not
+	//            streamed. The queries depend on this order.
+	mappingPending uint8 = iota
+	mappingOK
+	mappingProtected
+	mappingNotFound
+	mappingSuspended
+)
+
+// window is the length of the Twitter rate limit window, which is used when a
+// rate limit error does not say when it resets.
+const window = time.Minute * 15
+
+type mapping struct {
+	_      [0]func()
+	New    string
+	Name   string
+	ID     int64
+	TID    int64
+	Status uint8
+	Old    uint8
+	Update bool
+}
+
+func mappingName(v uint8) string {
+	switch v {
+	case mappingOK:
+		return "ok"
+	case mappingProtected:
+		return "protected"
+	case mappingNotFound:
+		return "not_found"
+	case mappingSuspended:
+		return "suspended"
+	}
+	return "pending"
+}
+func lookupStatus(e *twitter.ErrorObj) uint8 {
+	// NOTE(dij): Suspended users are also returned as "resource-not-found", but
+	//            with a "Forbidden" title and a detail that says so.
+	switch {
+	case strings.Contains(strings.ToLower(e.Detail), "suspended"):
+		return mappingSuspended
+	case strings.HasSuffix(e.Type, "resource-not-found"):
+		return mappingNotFound
+	}
+	return mappingPending
+}
+
+// background runs resolve on a new thread, so the Twitter stream keeps being
+// read while it runs. The returned channel is closed once it's done.
+func (w *Watcher) background(x context.Context, q chan<- message, a uint8) chan struct{} {
+	l := make(chan struct{})
+	w.jobs.Add(1)
+	go func() {
+		v := time.Now()
+		w.resolve(x, q, a > 1)
+		w.metrics.resolved(time.Since(v))
+		close(l)
+		w.jobs.Done()
+	}()
+	return l
+}
+func (w *Watcher) resolve(x context.Context, q chan<- message, a bool) {
+	w.log.Info("Starting Twitter ID mapping resolve task..")
+	r, err := w.sql.QueryContext(x, "get_all")
+	if err != nil {
+		w.log.Error("Error getting Twitter mappings from database: %s!", err.Error())
+		return
+	}
+	var (
+		l       = make([]*mapping, 0, 64)
+		s       string
+		o       uint8
+		c, m, u int64
+	)
+	for r.Next() {
+		if err = r.Scan(&c, &m, &s, &u, &o); err != nil {
+			w.log.Error("Error scanning data into Twitter mappings from database: %s!", err.Error())
+			continue
+		}
+		if !a && (u != 0 || o != mappingPending) || len(s) == 0 {
+			continue
+		}
+		if cap(l) < int(c) {
+			l = append(make([]*mapping, 0, int(c)-cap(l)), l...)
+		}
+		l = append(l, &mapping{ID: m, TID: u, Name: s, Status: o, Old: o})
+	}
+	if r.Close(); len(l) == 0 {
+		w.log.Debug("Twitter resolve mapping is empty, not attempting to resolve..")
+		return
+	}
+	// NOTE(dij): Mappings with an ID are looked up by ID, so renames are found,
+	//            and the rest are looked up by name.
+	var d, n []*mapping
+	for _, v := range l {
+		if v.TID > 0 {
+			d = append(d, v)
+		} else {
+			n = append(n, v)
+		}
+	}
+	w.log.Debug("Twitter mapping generated, attempting to resolve %d IDs and %d usernames..", len(d), len(n))
+	if w.lookup(x, d, true) {
+		w.lookup(x, n, false)
+	}
+	for _, v := range l {
+		if v.Status != v.Old {
+			if _, err = w.sql.ExecContext(x, "status", v.Status, v.ID); err != nil {
+				w.log.Error("Error updating Twitter mapping status in the database: %s!", err.Error())
+				continue
+			}
+			w.log.Info(`Twitter mapping "%s" status changed from %s to %s.`, v.Name, mappingName(v.Old), mappingName(v.Status))
+			if v.Status >= mappingNotFound {
+				w.gone(x, q, v)
+			}
+		}
+		if !v.Update {
+			continue
+		}
+		if len(v.New) == 0 {
+			_, err = w.sql.ExecContext(x, "set", v.ID, uint64(v.TID), v.Name)
+		} else if _, err = w.sql.ExecContext(x, "set", v.ID, uint64(v.TID), v.New); err == nil {
+			w.renamed(x, q, v)
+		}
+		if err != nil {
+			w.log.Error("Error updating Twitter mappings in the database: %s!", err.Error())
+		}
+	}
+	w.log.Debug("Completed Twitter ID mapping resolve task!")
+}
+
+// lookup fetches the mappings by ID or username from Twitter in batches of 50,
+// using any account that is not rate limited. This returns false if every
+// account was rate limited before all mappings were looked up, the rest are
+// left for the next run.
+func (w *Watcher) lookup(x context.Context, l []*mapping, i bool) bool {
+	o := twitter.UserLookupOpts{UserFields: []twitter.UserField{twitter.UserFieldID, twitter.UserFieldUserName, twitter.UserFieldProtected}}
+	for q, z := 0, 0; q < len(l); q = z {
+		if z = q + 50; z > len(l) {
+			z = len(l)
+		}
+		s := w.free()
+		if s == nil {
+			w.log.Warning("Twitter user lookups are rate limited, %d mappings will be resolved on the next run!", len(l)-q)
+			return false
+		}
+		var (
+			k = make([]string, 0, z-q)
+			b = make(map[string]*mapping, z-q)
+		)
+		for _, v := range l[q:z] {
+			n := strings.ToLower(v.Name)
+			if i {
+				n = strconv.FormatInt(v.TID, 10)
+			}
+			k, b[n] = append(k, n), v
+		}
+		var (
+			r   *twitter.UserLookupResponse
+			err error
+		)
+		if i {
+			r, err = s.api.UserLookup(x, k, o)
+		} else {
+			r, err = s.api.UserNameLookup(x, k, o)
+		}
+		if err != nil {
+			if f, u := failure(err); f == failLimit {
+				// NOTE(dij): Try this batch again with another account.
+				w.limit(s, u)
+				z = q
+				continue
+			}
+			w.log.Error("Error retrieving data about Twitter mappings from Twitter: %s!", err.Error())
+			continue
+		}
+		if r.RateLimit != nil && r.RateLimit.Remaining == 0 {
+			w.limit(s, r.RateLimit.Reset.Time())
+		}
+		if r.Raw == nil {
+			continue
+		}
+		for _, v := range r.Raw.Users {
+			if v == nil {
+				continue
+			}
+			m := b[v.ID]
+			if !i {
+				m = b[strings.ToLower(v.UserName)]
+			}
+			if m == nil {
+				continue
+			}
+			if m.Status = mappingOK; v.Protected {
+				m.Status = mappingProtected
+			}
+			switch {
+			case !i:
+				m.TID, _ = strconv.ParseInt(v.ID, 10, 64)
+				m.Update = true
+				w.log.Trace(`Twitter username %s was resolved to "%s".`, m.Name, v.ID)
+			case !stringLowMatch(v.UserName, m.Name):
+				m.New, m.Update = v.UserName, true
+				w.log.Warning(`Found new name for ID "%s": %s => %s!`, v.ID, m.Name, m.New)
+			}
+		}
+		for _, v := range r.Raw.Errors {
+			if v == nil {
+				continue
+			}
+			n, _ := v.Value.(string)
+			m := b[strings.ToLower(n)]
+			if m == nil {
+				continue
+			}
+			if e := lookupStatus(v); e != mappingPending {
+				m.Status = e
+				continue
+			}
+			w.log.Warning(`Twitter returned an error for mapping "%s": %s!`, m.Name, v.Title+" "+v.Detail)
+		}
+	}
+	return true
+}
+
+// identify looks up the Twitter accounts by username, or by ID when prefixed
+// with "id:". The result is keyed by the lowercase username and "id:" with the
+// ID, so new subscriptions can be pinned to the account ID.
+func (w *Watcher) identify(x context.Context, l []string) (map[string]*twitter.UserObj, error) {
+	var n, d []string
+	for _, v := range l {
+		if strings.HasPrefix(v, "id:") {
+			d = append(d, v[3:])
+		} else {
+			n = append(n, v)
+		}
+	}
+	var (
+		o = twitter.UserLookupOpts{UserFields: []twitter.UserField{twitter.UserFieldID, twitter.UserFieldUserName}}
+		r = make(map[string]*twitter.UserObj, len(l))
+	)
+	for i, v := range [2][]string{n, d} {
+		for q, z := 0, 0; q < len(v); q = z {
+			if z = q + 100; z > len(v) {
+				z = len(v)
+			}
+			s := w.free()
+			if s == nil || !s.acct.ready() {
+				return nil, errLookup
+			}
+			var (
+				k   *twitter.UserLookupResponse
+				err error
+			)
+			if i == 0 {
+				k, err = s.api.UserNameLookup(x, v[q:z], o)
+			} else {
+				k, err = s.api.UserLookup(x, v[q:z], o)
+			}
+			if err != nil {
+				if f, u := failure(err); f == failLimit {
+					w.limit(s, u)
+				}
+				return nil, err
+			}
+			if k.RateLimit != nil && k.RateLimit.Remaining == 0 {
+				w.limit(s, k.RateLimit.Reset.Time())
+			}
+			if k.Raw == nil {
+				continue
+			}
+			for _, e := range k.Raw.Users {
+				if e == nil {
+					continue
+				}
+				r[strings.ToLower(e.UserName)], r["id:"+e.ID] = e, e
+			}
+		}
+	}
+	return r, nil
+}
+
+// gone tells every chat following the mapping that the Twitter account was
+// suspended or can't be found.
+func (w *Watcher) gone(x context.Context, q chan<- message, m *mapping) {
+	l := w.followers(x, "subscribers", m.ID)
+	if len(l) == 0 {
+		return
+	}
+	var s string
+	switch {
+	case m.Status == mappingSuspended:
+		s = "The Twitter account @" + m.Name + " has been suspended."
+	case m.TID == 0 && m.Old == mappingPending:
+		s = "I couldn't find the Twitter account @" + m.Name + ", please check that the name is correct."
+	default:
+		s = "I can't find the Twitter account @" + m.Name + " anymore, it may have been deleted."
+	}
+	s += "\n\nI won't be able to send you any Tweets from it. You can stop following it with \"/remove @" + m.Name + "\"."
+	for _, v := range l {
+		select {
+		case q <- message{tries: 2, chat: v, msg: telegram.NewMessage(v, s)}:
+		case <-x.Done():
+			return
+		}
+	}
+}
+func (w *Watcher) limit(s *shard, t time.Time) {
+	if time.Until(t) <= 0 {
+		t = time.Now().Add(window)
+	}
+	atomic.StoreInt64(&s.until, t.UnixNano())
+	w.with(fields{"account": s.id}).Warning("Twitter user lookups are rate limited until %s!", t.Format(time.RFC1123))
+}
+
+// renamed tells every chat following the mapping about the new name of the
+// Twitter account, with a button to stop following it.
+func (w *Watcher) renamed(x context.Context, q chan<- message, m *mapping) {
+	l := w.followers(x, "subscribers_tid", m.TID)
+	if len(l) == 0 {
+		return
+	}
+	var (
+		s = "@" + m.Name + " is now @" + m.New + " on Twitter. I'll keep sending you their Tweets under the new name."
+		t = strconv.FormatInt(m.TID, 10)
+		p []string
+	)
+	if r, err := w.sql.QueryContext(x, "renames", m.TID); err != nil {
+		w.log.Error("Error getting Twitter rename history from database: %s!", err.Error())
+	} else {
+		for r.Next() {
+			var n string
+			if err = r.Scan(&n); err != nil {
+				w.log.Error("Error scanning data into Twitter rename history from database: %s!", err.Error())
+				break
+			}
+			if !stringLowMatch(n, m.Name) && !stringLowMatch(n, m.New) {
+				p = append(p, "@"+n)
+			}
+		}
+		r.Close()
+	}
+	if len(p) > 0 {
+		s += "\n\nThey were previously known as " + strings.Join(p, ", ") + "."
+	}
+	for _, v := range l {
+		o := telegram.NewMessage(v, s)
+		o.ReplyMarkup = telegram.NewInlineKeyboardMarkup(telegram.NewInlineKeyboardRow(
+			telegram.NewInlineKeyboardButtonData("Unsubscribe", unsub+t),
+		))
+		select {
+		case q <- message{tries: 2, chat: v, msg: o}:
+		case <-x.Done():
+			return
+		}
+	}
+}
+func (w *Watcher) followers(x context.Context, n string, i int64) []int64 {
+	r, err := w.sql.QueryContext(x, n, i)
+	if err != nil {
+		w.log.Error("Error getting Twitter mapping subscribers from database: %s!", err.Error())
+		return nil
+	}
+	var (
+		l []int64
+		c int64
+	)
+	for r.Next() {
+		if err = r.Scan(&c); err != nil {
+			w.log.Error("Error scanning data into Twitter mapping subscribers from database: %s!", err.Error())
+			break
+		}
+		l = append(l, c)
+	}
+	r.Close()
+	return l
+}
@@ -0,0 +1,345 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+)
+
+// rules is a mapping of the Twitter stream rules added by the Watcher to the
+// user IDs that each rule follows.
+type rules map[twitter.TweetSearchStreamRuleID][]string
+
+func parseRule(v string) []string {
+	var r []string
+	for i := strings.Index(v, "from:"); i >= 0; i = strings.Index(v, "from:") {
+		v = v[i+5:]
+		e := strings.IndexAny(v, " )")
+		if e == -1 {
+			e = len(v)
+		}
+		if e > 0 {
+			r = append(r, v[:e])
+		}
+		v = v[e:]
+	}
+	return r
+}
+func isLegacyRule(v string) bool {
+	return strings.HasPrefix(strings.TrimSpace(v), "(from:") && strings.HasSuffix(v, ") -is:retweet -is:quote -is:reply lang:en")
+}
+
+// packRules places the user IDs into at most c rules that are at most n chars
+// long, using first fit decreasing. Any IDs that do not fit are returned.
+func packRules(t string, l []string, n, c int) ([]twitter.TweetSearchStreamRule, []string) {
+	v := make([]string, len(l))
+	copy(v, l)
+	sort.Slice(v, func(i, j int) bool {
+		if len(v[i]) == len(v[j]) {
+			return v[i] < v[j]
+		}
+		return len(v[i]) > len(v[j])
+	})
+	var (
+		b []*strings.Builder
+		o []string
+	)
+	for i := range v {
+		var (
+			z = len(v[i]) + 5
+			f bool
+		)
+		for k := range b {
+			// NOTE(dij): Each rule is wrapped with the 42 chars of "( ... )"
+			//            and the filters, and each extra user adds " OR ".
+			if b[k].Len()+z+4+42 > n {
+				continue
+			}
+			b[k].WriteString(" OR from:" + v[i])
+			f = true
+			break
+		}
+		if f {
+			continue
+		}
+		if len(b) >= c || z+42 > n {
+			o = append(o, v[i])
+			continue
+		}
+		k := builders.Get().(*strings.Builder)
+		k.WriteString("from:" + v[i])
+		b = append(b, k)
+	}
+	r := make([]twitter.TweetSearchStreamRule, len(b))
+	for i := range b {
+		r[i] = twitter.TweetSearchStreamRule{Value: "(" + b[i].String() + ") -is:retweet -is:quote -is:reply lang:en", Tag: t}
+		b[i].Reset()
+		builders.Put(b[i])
+	}
+	return r, o
+}
+func (w *Watcher) wanted(x context.Context) (map[string]struct{}, error) {
+	r, err := w.sql.QueryContext(x, "get_list")
+	if err != nil {
+		w.log.Error("Error getting Twitter list from database: %s!", err.Error())
+		return nil, err
+	}
+	var (
+		l map[string]struct{}
+		s int64
+		c int
+	)
+	for r.Next() {
+		if err = r.Scan(&c, &s); err != nil {
+			w.log.Error("Error scanning data into Twitter list from database: %s!", err.Error())
+			break
+		}
+		if l == nil {
+			l = make(map[string]struct{}, c)
+		}
+		if s == 0 || c == 0 {
+			continue
+		}
+		l[strconv.FormatInt(s, 10)] = struct{}{}
+	}
+	if r.Close(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+func (w *Watcher) update(x context.Context, s *shard, k rules) ([]string, error) {
+	l, err := w.wanted(x)
+	if err != nil {
+		return nil, err
+	}
+	if len(w.shards) > 1 {
+		for u := range l {
+			if w.owner(u) != s {
+				delete(l, u)
+			}
+		}
+	}
+	var (
+		t = s.api
+		z = w.with(fields{"account": s.id})
+	)
+	// NOTE(dij): Check what Twitter actually has, so any of our rules that
+	//            were removed outside of the Watcher are added back and any
+	//            left over from a previous run are reused or removed.
+	r, err := t.TweetSearchStreamRules(x, nil)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		e = make(map[twitter.TweetSearchStreamRuleID]struct{}, len(r.Rules))
+		d []twitter.TweetSearchStreamRuleID
+		g int
+	)
+	for _, v := range r.Rules {
+		if v == nil {
+			continue
+		}
+		switch {
+		case v.Tag == s.tag:
+			if _, ok := k[v.ID]; !ok {
+				w.with(fields{"account": s.id, "rule_id": v.ID}).Info("Found existing Twitter stream rule %s from a previous run.", v.ID)
+			}
+			k[v.ID], e[v.ID] = parseRule(v.Value), struct{}{}
+		case len(v.Tag) == 0 && isLegacyRule(v.Value):
+			// NOTE(dij): Rules from older versions have no tag, but can be
+			//            found by their format.
+			w.with(fields{"account": s.id, "rule_id": v.ID}).Info("Removing untagged Twitter stream rule %s from a previous run.", v.ID)
+			d = append(d, v.ID)
+		default:
+			g++
+		}
+	}
+	for i := range k {
+		if _, ok := e[i]; !ok {
+			w.with(fields{"account": s.id, "rule_id": i}).Warning("Twitter stream rule %s was removed outside of the Watcher!", i)
+			delete(k, i)
+		}
+	}
+	var (
+		c = make(map[string]struct{}, len(l))
+		q = make([]string, 0, len(k))
+		m = w.tier.Rules - g
+		b = len(d)
+		n []string
+		h int
+	)
+	for i := range k {
+		q = append(q, string(i))
+	}
+	sort.Strings(q)
+	// NOTE(dij): Rules that only follow users we still want are kept as-is,
+	//            any rule following a removed user is replaced and the users
+	//            it still covers are packed with the new ones. Rules that only
+	//            follow users covered by another rule are duplicates, which
+	//            can be left behind by a crash.
+	for _, i := range q {
+		var (
+			v    = k[twitter.TweetSearchStreamRuleID(i)]
+			o, f = true, false
+		)
+		for _, u := range v {
+			if _, ok := l[u]; !ok {
+				o = false
+				break
+			}
+			if _, ok := c[u]; !ok {
+				f = true
+			}
+		}
+		if !o || !f {
+			d = append(d, twitter.TweetSearchStreamRuleID(i))
+			continue
+		}
+		for _, u := range v {
+			c[u] = struct{}{}
+		}
+		h++
+	}
+	for u := range l {
+		if _, ok := c[u]; !ok {
+			n = append(n, u)
+		}
+	}
+	p, f := packRules(s.tag, n, w.tier.Length, m-h)
+	if len(f) > 0 {
+		// NOTE(dij): Out of space, see if packing every user from scratch fits
+		//            more of them. This replaces every rule, so it's only done
+		//            when it's better.
+		a := make([]string, 0, len(l))
+		for u := range l {
+			a = append(a, u)
+		}
+		if y, o := packRules(s.tag, a, w.tier.Length, m); len(o) < len(f) {
+			z.Info("Twitter stream rules are full, re-packing all %d users..", len(l))
+			d, p, f = d[:b], y, o
+			for _, i := range q {
+				d = append(d, twitter.TweetSearchStreamRuleID(i))
+			}
+		}
+	}
+	if len(f) > 0 {
+		z.Warning("Twitter stream rules are full (%d max), %d users will be polled instead!", w.tier.Rules, len(f))
+	}
+	if len(p) == 0 && len(d) == 0 {
+		atomic.StoreInt64(&s.rules, int64(len(k)))
+		z.Debug("Twitter stream rules are up to date, following %d users with %d rules.", len(l)-len(f), len(k))
+		return f, nil
+	}
+	// NOTE(dij): Add the new rules before removing the old ones when there is
+	//            space, so users that move between rules are never missed. Any
+	//            duplicate Tweets in between are caught by the duplicate check.
+	if g+len(k)+b+len(p) <= w.tier.Rules {
+		if err = w.addRules(x, s, k, p); err == nil {
+			err = w.removeRules(x, s, k, d)
+		}
+	} else if err = w.removeRules(x, s, k, d); err == nil {
+		err = w.addRules(x, s, k, p)
+	}
+	if atomic.StoreInt64(&s.rules, int64(len(k))); err != nil {
+		return f, err
+	}
+	z.Info("Twitter stream rules updated, following %d users with %d rules (%d added, %d removed).", len(l)-len(f), len(k), len(p), len(d))
+	return f, nil
+}
+
+// reload updates the rules of the shard and returns the users that did not fit
+// in them. A failed update is retried after a backoff, as the rules can be left
+// half updated.
+func (w *Watcher) reload(x context.Context, q chan<- message, s *shard, k rules, b *backoff, v []string) []string {
+	atomic.AddUint64(&w.metrics.reloads, 1)
+	w.with(fields{"account": s.id}).Debug("Updating Twitter stream rules..")
+	f, err := w.update(x, s, k)
+	if w.fanout(s); err != nil {
+		d := b.next(failure(err))
+		w.with(fields{"account": s.id}).Error("Error updating Twitter stream rules, retrying in %s: %s!", d.String(), err.Error())
+		w.again(s, d)
+		return v
+	}
+	b.reset()
+	w.overflow(x, q, s, v, f)
+	return f
+}
+func (w *Watcher) addRules(x context.Context, s *shard, k rules, p []twitter.TweetSearchStreamRule) error {
+	if len(p) == 0 {
+		return nil
+	}
+	y, err := s.api.TweetSearchStreamAddRule(x, p, false)
+	if err != nil {
+		return err
+	}
+	for i := range y.Errors {
+		w.with(fields{"account": s.id}).Error("Error adding Twitter stream rule: %s!", y.Errors[i].Title+" "+y.Errors[i].Detail)
+	}
+	for i := range y.Rules {
+		k[y.Rules[i].ID] = parseRule(y.Rules[i].Value)
+		w.with(fields{"account": s.id, "rule_id": y.Rules[i].ID}).Debug("Added Twitter stream rule %s.", y.Rules[i].ID)
+	}
+	return nil
+}
+func (w *Watcher) removeRules(x context.Context, s *shard, k rules, d []twitter.TweetSearchStreamRuleID) error {
+	if len(d) == 0 {
+		return nil
+	}
+	if _, err := s.api.TweetSearchStreamDeleteRuleByID(x, d, false); err != nil {
+		return err
+	}
+	for i := range d {
+		delete(k, d[i])
+		w.with(fields{"account": s.id, "rule_id": d[i]}).Debug("Removed Twitter stream rule %s.", d[i])
+	}
+	return nil
+}
+func (w *Watcher) overflow(x context.Context, m chan<- message, s *shard, o, n []string) {
+	if atomic.StoreInt64(&s.extra, int64(len(n))); len(o) == len(n) {
+		e := true
+		for i := range o {
+			if o[i] != n[i] {
+				e = false
+				break
+			}
+		}
+		if e {
+			return
+		}
+	}
+	// NOTE(dij): Each account sends its own notice, so say which one it is.
+	var a string
+	if len(w.shards) > 1 {
+		a = " of account " + strconv.Itoa(s.id)
+	}
+	if len(n) == 0 {
+		w.with(fields{"account": s.id}).Info("All followed Twitter users fit in the stream rules, polling stopped.")
+		w.notify(x, m, "All followed Twitter users fit in the stream rules"+a+" again, so I stopped polling for their Tweets.")
+		return
+	}
+	w.notify(x, m,
+		"The Twitter stream rules"+a+" are full ("+strconv.Itoa(w.tier.Rules)+" rules of "+strconv.Itoa(w.tier.Length)+" characters), so "+
+			strconv.Itoa(len(n))+" followed users are being polled every "+w.every.String()+" instead.\n\n"+
+			"Tweets from these users will be delayed. Check the \"tier\", \"rules\" and \"rule_length\" settings if your Twitter API access allows more rules.",
+	)
+}
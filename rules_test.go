@@ -0,0 +1,140 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func ids(n, s int) []string {
+	r := make([]string, n)
+	for i := range r {
+		r[i] = strconv.Itoa(s + i)
+	}
+	return r
+}
+func TestParseRule(t *testing.T) {
+	for _, v := range []struct {
+		name, rule string
+		want       []string
+	}{
+		{"empty", "", nil},
+		{"no users", "hello world lang:en", nil},
+		{"single", "from:12", []string{"12"}},
+		{"packed", "(from:1 OR from:22 OR from:333) -is:retweet -is:quote -is:reply lang:en", []string{"1", "22", "333"}},
+		{"unwrapped", "from:1 from:2", []string{"1", "2"}},
+		{"empty user", "(from: OR from:5) lang:en", []string{"5"}},
+	} {
+		if r := parseRule(v.rule); !reflect.DeepEqual(r, v.want) {
+			t.Errorf("%s: parseRule(%q) = %q, want %q", v.name, v.rule, r, v.want)
+		}
+	}
+}
+func TestIsLegacyRule(t *testing.T) {
+	for _, v := range []struct {
+		name, rule string
+		want       bool
+	}{
+		{"empty", "", false},
+		{"legacy", "(from:1 OR from:2) -is:retweet -is:quote -is:reply lang:en", true},
+		{"legacy spaced", "  (from:1) -is:retweet -is:quote -is:reply lang:en", true},
+		{"unwrapped", "from:1 -is:retweet -is:quote -is:reply lang:en", false},
+		{"other filters", "(from:1) -is:retweet lang:en", false},
+		{"other rule", "(cats OR dogs) -is:retweet -is:quote -is:reply lang:en", false},
+	} {
+		if r := isLegacyRule(v.rule); r != v.want {
+			t.Errorf("%s: isLegacyRule(%q) = %t, want %t", v.name, v.rule, r, v.want)
+		}
+	}
+}
+func TestPackRules(t *testing.T) {
+	// NOTE(dij): Each rule adds 42 chars around the users, so an 18 digit ID
+	//            takes 23 chars for the first user in a rule and 27 for each
+	//            one after it. That's 17 users in a 512 char rule and 36 users
+	//            in a 1024 char rule.
+	for _, v := range []struct {
+		name       string
+		users      []string
+		length     int
+		count      int
+		rules, out int
+	}{
+		{"empty", nil, 512, 5, 0, 0},
+		{"single", []string{"1"}, 512, 5, 1, 0},
+		{"one full rule", ids(17, 100000000000000000), 512, 5, 1, 0},
+		{"two rules", ids(18, 100000000000000000), 512, 5, 2, 0},
+		{"essential", ids(85, 100000000000000000), 512, 5, 5, 0},
+		{"essential overflow", ids(100, 100000000000000000), 512, 5, 5, 15},
+		{"elevated", ids(100, 100000000000000000), 512, 25, 6, 0},
+		{"academic", ids(100, 100000000000000000), 1024, 1000, 3, 0},
+		{"no rules", ids(10, 1), 512, 0, 0, 10},
+		{"too short", []string{"123456789"}, 50, 5, 0, 1},
+		{"mixed lengths", append(ids(17, 100000000000000000), ids(10, 1)...), 512, 5, 2, 0},
+	} {
+		r, o := packRules("watcher", v.users, v.length, v.count)
+		if len(r) != v.rules || len(o) != v.out {
+			t.Errorf("%s: got %d rules and %d overflow, want %d rules and %d overflow", v.name, len(r), len(o), v.rules, v.out)
+			continue
+		}
+		s := make(map[string]int, len(v.users))
+		for _, u := range o {
+			s[u]++
+		}
+		for _, e := range r {
+			if e.Tag != "watcher" {
+				t.Errorf("%s: rule %q has tag %q, want %q", v.name, e.Value, e.Tag, "watcher")
+			}
+			if len(e.Value) > v.length {
+				t.Errorf("%s: rule %q is %d chars, over the %d limit", v.name, e.Value, len(e.Value), v.length)
+			}
+			if !isLegacyRule(e.Value) {
+				t.Errorf("%s: rule %q does not have the expected format", v.name, e.Value)
+			}
+			for _, u := range parseRule(e.Value) {
+				s[u]++
+			}
+		}
+		if len(s) != len(v.users) {
+			t.Errorf("%s: %d users were placed, want %d", v.name, len(s), len(v.users))
+		}
+		for _, u := range v.users {
+			if s[u] != 1 {
+				t.Errorf("%s: user %q was placed %d times, want once", v.name, u, s[u])
+			}
+		}
+	}
+}
+func TestPackRulesDecreasing(t *testing.T) {
+	// NOTE(dij): Longer IDs are placed first, so the short ones are the ones
+	//            that overflow and the input is left untouched.
+	var (
+		l    = []string{"1", "22", "333", "100000000000000000"}
+		c    = append([]string(nil), l...)
+		r, o = packRules("watcher", l, 80, 1)
+	)
+	if !reflect.DeepEqual(l, c) {
+		t.Errorf("packRules changed the input to %q", l)
+	}
+	if len(r) != 1 || r[0].Value != "(from:100000000000000000 OR from:333) -is:retweet -is:quote -is:reply lang:en" {
+		t.Errorf("packRules returned %v, want a single rule with the two longest users", r)
+	}
+	if !reflect.DeepEqual(o, []string{"22", "1"}) {
+		t.Errorf("packRules overflow = %q, want %q", o, []string{"22", "1"})
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func (w *Watcher) serve(x context.Context, g *sync.WaitGroup) {
+	if len(w.listen) == 0 {
+		return
+	}
+	m := http.NewServeMux()
+	m.HandleFunc("/healthz", w.serveHealth)
+	m.HandleFunc("/readyz", w.serveHealth)
+	m.HandleFunc("/metrics", w.serveMetrics)
+	s := &http.Server{
+		Addr:              w.listen,
+		Handler:           m,
+		ReadTimeout:       time.Second * 10,
+		WriteTimeout:      time.Second * 10,
+		ReadHeaderTimeout: time.Second * 5,
+	}
+	w.log.Info("Starting HTTP listener on %q..", w.listen)
+	g.Add(1)
+	go func() {
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			w.log.Error("Error starting HTTP listener on %q: %s!", w.listen, err.Error())
+		}
+	}()
+	go func() {
+		<-x.Done()
+		w.log.Info("Stopping HTTP listener.")
+		v, f := context.WithTimeout(context.Background(), time.Second*5)
+		s.Shutdown(v)
+		f()
+		g.Done()
+	}()
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	twitter "github.com/g8rswimmer/go-twitter/v2"
+)
+
+// shard is a set of Twitter credentials that runs its own stream. The followed
+// users are spread across the healthy shards.
+type shard struct {
+	// NOTE(dij): These are first to keep them 64-bit aligned for the atomic
+	//            functions on 32-bit platforms, status also starts with its
+	//            int64 heartbeat for the same reason.
+	status
+	rules   int64
+	extra   int64
+	until   int64
+	healthy int32
+	filling int32
+	polling int32
+	waiting int32
+	id      int
+	tag     string
+	c       chan uint8
+	acct    *account
+	api     *twitter.Client
+}
+
+func (w *Watcher) pick() *shard {
+	if len(w.shards) == 1 {
+		return w.shards[0]
+	}
+	// NOTE(dij): Round robin over the healthy shards to spread the lookup
+	//            rate limits.
+	n := atomic.AddUint32(&w.next, 1)
+	for i := range w.shards {
+		if s := w.shards[(int(n)+i)%len(w.shards)]; atomic.LoadInt32(&s.healthy) == 1 {
+			return s
+		}
+	}
+	return w.shards[int(n)%len(w.shards)]
+}
+
+// free returns a shard that is not rate limited for user lookups, starting with
+// the next one picked. This returns nil if every shard is rate limited.
+func (w *Watcher) free() *shard {
+	var (
+		n = time.Now().UnixNano()
+		s = w.pick()
+	)
+	if atomic.LoadInt64(&s.until) <= n {
+		return s
+	}
+	for _, v := range w.shards {
+		if atomic.LoadInt64(&v.until) <= n {
+			return v
+		}
+	}
+	return nil
+}
+
+// owner returns the shard that streams the user ID. This uses rendezvous
+// hashing, so only the users of a shard that fails are moved. If no shards are
+// healthy, every shard is used.
+func (w *Watcher) owner(u string) *shard {
+	if len(w.shards) == 1 {
+		return w.shards[0]
+	}
+	var (
+		r *shard
+		v uint64
+		a = true
+	)
+	for _, s := range w.shards {
+		if atomic.LoadInt32(&s.healthy) == 1 {
+			a = false
+			break
+		}
+	}
+	for _, s := range w.shards {
+		if !a && atomic.LoadInt32(&s.healthy) == 0 {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(u + ":" + strconv.Itoa(s.id)))
+		if k := h.Sum64(); r == nil || k > v {
+			r, v = s, k
+		}
+	}
+	return r
+}
+
+// mark sets the health of the shard. Any change triggers a rule update on every
+// shard to move the users to or from it.
+func (w *Watcher) mark(s *shard, h bool) {
+	var v int32
+	if h {
+		v = 1
+	}
+	if atomic.SwapInt32(&s.healthy, v) == v || len(w.shards) == 1 {
+		return
+	}
+	if h {
+		w.log.Info("Twitter account %d is healthy again, moving users back to it..", s.id)
+	} else {
+		w.log.Warning("Twitter account %d is unhealthy, moving its users to the other accounts..", s.id)
+	}
+	select {
+	case w.shards[0].c <- 0:
+	default:
+	}
+}
+
+// fanout passes a rule update to every other shard, which is done by the first
+// shard once its own update is done.
+func (w *Watcher) fanout(s *shard) {
+	if s.id != 0 {
+		return
+	}
+	for _, v := range w.shards[1:] {
+		select {
+		case v.c <- 0:
+		default:
+		}
+	}
+}
+
+// again asks for the rules of the shard to be updated again after the wait,
+// unless a retry is already waiting.
+func (w *Watcher) again(s *shard, d time.Duration) {
+	if !atomic.CompareAndSwapInt32(&s.waiting, 0, 1) {
+		return
+	}
+	time.AfterFunc(d, func() {
+		atomic.StoreInt32(&s.waiting, 0)
+		select {
+		case s.c <- 0:
+		default:
+		}
+	})
+}
@@ -0,0 +1,229 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	stateNone uint8 = iota
+	stateClear
+	stateKeywords
+	stateOnboard
+	stateImport
+	stateBroadcast
+)
+
+// unsub is the callback data prefix of the unsubscribe button, followed by the
+// Twitter user ID. It does not depend on the conversation state.
+const unsub = "unsub:"
+
+const expired = `I'm sorry, but that request has expired.
+
+Please run the command again.`
+
+type state struct {
+	data   string
+	action uint8
+}
+
+func isYes(s string) bool {
+	return stringLowMatch(s, "yes") || stringLowMatch(s, "y") || stringLowMatch(s, "confirm")
+}
+func isNo(s string) bool {
+	return stringLowMatch(s, "no") || stringLowMatch(s, "n") || stringLowMatch(s, "cancel")
+}
+func keyboard(a uint8, y bool) telegram.InlineKeyboardMarkup {
+	v := strconv.FormatUint(uint64(a), 10)
+	if !y {
+		return telegram.NewInlineKeyboardMarkup(telegram.NewInlineKeyboardRow(
+			telegram.NewInlineKeyboardButtonData("Cancel", v+":n"),
+		))
+	}
+	return telegram.NewInlineKeyboardMarkup(telegram.NewInlineKeyboardRow(
+		telegram.NewInlineKeyboardButtonData("Yes", v+":y"),
+		telegram.NewInlineKeyboardButtonData("No", v+":n"),
+	))
+}
+func (w *Watcher) endState(x context.Context, i int64) {
+	if _, err := w.sql.ExecContext(x, "state_del", i); err != nil {
+		w.log.Error("Error removing conversation state for chat %d from database: %s!", i, err.Error())
+	}
+}
+func (w *Watcher) getState(x context.Context, i int64) (state, error) {
+	r, ok := w.sql.QueryRowContext(x, "state_get", i)
+	if !ok {
+		return state{}, sql.ErrConnDone
+	}
+	var (
+		s state
+		d sql.NullString
+	)
+	switch err := r.Scan(&s.action, &d); err {
+	case nil:
+	case sql.ErrNoRows:
+		return state{}, nil
+	default:
+		return state{}, err
+	}
+	s.data = d.String
+	return s, nil
+}
+func (w *Watcher) setState(x context.Context, i int64, a uint8, d string) bool {
+	_, err := w.sql.ExecContext(
+		x, "state_set", i, a, sql.NullString{String: d, Valid: len(d) > 0}, int64(w.expire.Seconds()),
+	)
+	if err != nil {
+		w.log.Error("Error saving conversation state for chat %d to database: %s!", i, err.Error())
+		return false
+	}
+	return true
+}
+func (w *Watcher) prompt(x context.Context, i int64, o *telegram.MessageConfig) string {
+	if !w.setState(x, i, stateClear, "") {
+		return errmsg
+	}
+	o.ReplyMarkup = keyboard(stateClear, true)
+	return `Are you sure you want to clear your following list?`
+}
+func (w *Watcher) onboard(x context.Context, i int64, o *telegram.MessageConfig) string {
+	if !w.setState(x, i, stateOnboard, "") {
+		return errmsg
+	}
+	o.ReplyMarkup = keyboard(stateOnboard, false)
+	return `Hello! I can send you a message whenever someone you follow posts a new Tweet.
+
+To get started, reply with the users you would like me to follow, with an optional keyword list:
+<@username1,@usernameN,..> [keyword1,keywordN,..]`
+}
+func (w *Watcher) keywords(x context.Context, i int64, s string, o *telegram.MessageConfig) string {
+	if !isValid(s) {
+		return `The username "` + s + `" is not a valid Twitter username!` + "\n\nTwitter names must start with \"@\" and contain no special characters or spaces."
+	}
+	if !w.setState(x, i, stateKeywords, s[1:]) {
+		return errmsg
+	}
+	o.ReplyMarkup = keyboard(stateKeywords, false)
+	return `Please reply with the new keyword list for ` + s + `, or "none" to remove all keywords.`
+}
+func (w *Watcher) upload(x context.Context, i int64, o *telegram.MessageConfig) string {
+	if !w.setState(x, i, stateImport, "") {
+		return errmsg
+	}
+	o.ReplyMarkup = keyboard(stateImport, false)
+	return `Please reply with the JSON or CSV file that you would like to import.`
+}
+func (w *Watcher) reply(x context.Context, i, u int64, v string, m chan<- message, c chan<- uint8) string {
+	s, err := w.getState(x, i)
+	if err != nil {
+		w.log.Error("Error getting conversation state for chat %d from database: %s!", i, err.Error())
+		return errmsg
+	}
+	if s.action == stateNone {
+		return invalid
+	}
+	if v = strings.TrimSpace(v); isNo(v) {
+		w.endState(x, i)
+		return "Alright, I have cancelled that request."
+	}
+	switch s.action {
+	case stateClear, stateBroadcast:
+		if !isYes(v) {
+			return `Please use the buttons above or reply with "confirm" in order to continue.`
+		}
+		return w.complete(x, i, u, s, "", m, c)
+	case stateKeywords, stateOnboard:
+		return w.complete(x, i, u, s, v, m, c)
+	case stateImport:
+		return `Please reply with the JSON or CSV file that you would like to import.`
+	}
+	return invalid
+}
+func (w *Watcher) callback(x context.Context, q *telegram.CallbackQuery, m chan<- message, c chan<- uint8) string {
+	if strings.HasPrefix(q.Data, unsub) {
+		return w.unsubscribe(x, q.Message.Chat.ID, q.From.ID, q.Data[len(unsub):], c)
+	}
+	if len(q.Data) < 3 || q.Data[len(q.Data)-2] != ':' {
+		return expired
+	}
+	a, err := strconv.ParseUint(q.Data[:len(q.Data)-2], 10, 8)
+	if err != nil {
+		return expired
+	}
+	s, err := w.getState(x, q.Message.Chat.ID)
+	if err != nil {
+		w.log.Error("Error getting conversation state for chat %d from database: %s!", q.Message.Chat.ID, err.Error())
+		return errmsg
+	}
+	if s.action == stateNone || s.action != uint8(a) {
+		return expired
+	}
+	if q.Data[len(q.Data)-1] != 'y' {
+		w.endState(x, q.Message.Chat.ID)
+		return "Alright, I have cancelled that request."
+	}
+	if s.action != stateClear && s.action != stateBroadcast {
+		return expired
+	}
+	return w.complete(x, q.Message.Chat.ID, q.From.ID, s, "", m, c)
+}
+func (w *Watcher) complete(x context.Context, i, u int64, s state, v string, m chan<- message, c chan<- uint8) string {
+	switch s.action {
+	case stateBroadcast:
+		if !w.isAdmin(x, u) {
+			return denied
+		}
+		w.endState(x, i)
+		n, err := w.broadcast(x, s.data)
+		if err != nil {
+			w.log.Error("Error getting Telegram chat list from database: %s!", err.Error())
+			return errmsg
+		}
+		return "Awesome! I am sending your announcement to " + strconv.Itoa(n) + " chats."
+	case stateClear:
+		if w.endState(x, i); !w.clear(x, i, u) {
+			return errmsg
+		}
+		c <- 0
+		return "Awesome! I have cleared your following list!"
+	case stateKeywords:
+		if stringLowMatch(v, "none") {
+			v = ""
+		}
+		r := w.action(x, i, u, "@"+s.data+" "+v, true, nil, c)
+		if r == updated {
+			w.endState(x, i)
+		}
+		return r
+	case stateOnboard:
+		if len(v) == 0 || v[0] != '@' {
+			return `Please reply with the users you would like me to follow, starting with "@".`
+		}
+		r := w.action(x, i, u, v, true, nil, c)
+		if r == updated {
+			w.endState(x, i)
+		}
+		return r
+	}
+	return invalid
+}
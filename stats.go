@@ -0,0 +1,132 @@
+// Copyright 2021 - 2023 PurpleSec Team
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package watcher
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// rollup is how often the in-memory counters are added to the daily statistics
+// table in the database.
+const rollup = time.Minute * 5
+
+type counters struct {
+	received  uint64
+	delivered uint64
+	filtered  uint64
+	failed    uint64
+}
+type stats struct {
+	now   counters
+	last  counters
+	start time.Time
+	depth func() (int, int, int)
+}
+
+func (c *counters) load() counters {
+	return counters{
+		received:  atomic.LoadUint64(&c.received),
+		delivered: atomic.LoadUint64(&c.delivered),
+		filtered:  atomic.LoadUint64(&c.filtered),
+		failed:    atomic.LoadUint64(&c.failed),
+	}
+}
+func (w *Watcher) flush() {
+	v := w.stats.now.load()
+	d := counters{
+		received:  v.received - w.stats.last.received,
+		delivered: v.delivered - w.stats.last.delivered,
+		filtered:  v.filtered - w.stats.last.filtered,
+		failed:    v.failed - w.stats.last.failed,
+	}
+	if d.received == 0 && d.delivered == 0 && d.filtered == 0 && d.failed == 0 {
+		return
+	}
+	if _, err := w.sql.Exec("stats_add", d.received, d.delivered, d.filtered, d.failed); err != nil {
+		w.log.Error("Error adding statistics to database: %s!", err.Error())
+		return
+	}
+	w.stats.last = v
+}
+func (w *Watcher) statistics(x context.Context) string {
+	r, ok := w.sql.QueryRowContext(x, "stats")
+	if !ok {
+		return errmsg
+	}
+	var c, m, u, g int64
+	if err := r.Scan(&c, &m, &u, &g); err != nil {
+		w.log.Error("Error getting statistics from database: %s!", err.Error())
+		return errmsg
+	}
+	var (
+		v = w.stats.now.load()
+		b = builders.Get().(*strings.Builder)
+	)
+	b.WriteString("Statistics since " + w.stats.start.Format(time.RFC1123) + " (up " + time.Since(w.stats.start).Truncate(time.Second).String() + ")\n\n")
+	b.WriteString("Chats: " + strconv.FormatInt(c, 10) + "\n")
+	b.WriteString("Mappings: " + strconv.FormatInt(m, 10) + " (" + strconv.FormatInt(u, 10) + " unresolved, " + strconv.FormatInt(g, 10) + " missing or suspended)\n")
+	var n, e int64
+	for _, v := range w.shards {
+		n, e = n+atomic.LoadInt64(&v.rules), e+atomic.LoadInt64(&v.extra)
+	}
+	b.WriteString("Stream Rules: " + strconv.FormatInt(n, 10) + "\n")
+	b.WriteString("Polled Users: " + strconv.FormatInt(e, 10) + "\n")
+	if len(w.shards) > 1 {
+		for _, v := range w.shards {
+			b.WriteString("Twitter Account " + strconv.Itoa(v.id) + ": " + streamName(atomic.LoadInt32(&v.stream)))
+			if atomic.LoadInt32(&v.healthy) == 0 {
+				b.WriteString(" (unhealthy)")
+			}
+			b.WriteString(", " + strconv.FormatInt(atomic.LoadInt64(&v.rules), 10) + " rules\n")
+		}
+	}
+	b.WriteString("Tweets Received: " + strconv.FormatUint(v.received, 10) + "\n")
+	b.WriteString("Tweets Delivered: " + strconv.FormatUint(v.delivered, 10) + "\n")
+	b.WriteString("Tweets Filtered: " + strconv.FormatUint(v.filtered, 10) + "\n")
+	b.WriteString("Tweets Failed: " + strconv.FormatUint(v.failed, 10) + "\n")
+	if w.stats.depth != nil {
+		q, t, k := w.stats.depth()
+		b.WriteString("Queue Depth: " + strconv.Itoa(q) + " messages, " + strconv.Itoa(t) + " tweets, " + strconv.Itoa(k) + " reloads\n")
+	}
+	if d, err := w.sql.QueryContext(x, "stats_days"); err == nil {
+		var (
+			s          string
+			e, f, g, h uint64
+		)
+		for b.WriteString("\nPer Day (received/delivered/filtered/failed):\n"); d.Next(); {
+			if err = d.Scan(&s, &e, &f, &g, &h); err != nil {
+				w.log.Error("Error scanning data into statistics from database: %s!", err.Error())
+				continue
+			}
+			b.WriteString(
+				"- " + s + ": " + strconv.FormatUint(e, 10) + "/" + strconv.FormatUint(f, 10) + "/" +
+					strconv.FormatUint(g, 10) + "/" + strconv.FormatUint(h, 10) + "\n",
+			)
+		}
+		d.Close()
+	} else {
+		w.log.Error("Error getting daily statistics from database: %s!", err.Error())
+	}
+	s := b.String()
+	b.Reset()
+	builders.Put(b)
+	return s
+}
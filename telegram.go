@@ -22,22 +22,24 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	twitter "github.com/g8rswimmer/go-twitter/v2"
 	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
+// forever is the amount of seconds past which a pause is considered to be
+// indefinite, as indefinite pauses are stored as the maximum date value.
+const forever = 315360000
+
 var builders = sync.Pool{
 	New: func() interface{} {
 		return new(strings.Builder)
 	},
 }
 
-var confirm struct{}
-
-func (w *Watcher) clear(x context.Context, i int64) bool {
-	if _, err := w.sql.ExecContext(x, "del_all", i); err != nil {
+func (w *Watcher) clear(x context.Context, i, u int64) bool {
+	if _, err := w.sql.ExecContext(x, "del_all", i, u); err != nil {
 		w.log.Error("Error clearing Twitter subscriptions from database: %s!", err.Error())
 		return false
 	}
@@ -52,12 +54,14 @@ func (w *Watcher) list(x context.Context, i int64) string {
 	var (
 		c int
 		t int64
+		o uint8
 		s string
 		k sql.NullString
+		p sql.NullInt64
 		b = builders.Get().(*strings.Builder)
 	)
 	for b.WriteString("I am currently following these users:\n"); r.Next(); {
-		if err := r.Scan(&s, &t, &k); err != nil {
+		if err := r.Scan(&s, &t, &o, &k, &p); err != nil {
 			w.log.Error("Error scanning data into Twitter subscriptions list from database: %s!", err.Error())
 			continue
 		}
@@ -65,8 +69,22 @@ func (w *Watcher) list(x context.Context, i int64) string {
 			continue
 		}
 		b.WriteString("- @" + s)
-		if t == 0 {
-			b.WriteString(" (Might not be valid!)")
+		switch {
+		case o == mappingProtected:
+			b.WriteString(" (Protected)")
+		case o == mappingNotFound:
+			b.WriteString(" (Not found on Twitter!)")
+		case o == mappingSuspended:
+			b.WriteString(" (Suspended!)")
+		case t == 0:
+			b.WriteString(" (Not checked yet)")
+		}
+		switch {
+		case !p.Valid || p.Int64 <= 0:
+		case p.Int64 > forever:
+			b.WriteString(" (Paused)")
+		default:
+			b.WriteString(" (Paused for " + (time.Duration(p.Int64) * time.Second).String() + ")")
 		}
 		if k.Valid && len(k.String) > 0 {
 			b.WriteString("\n  [" + k.String + "]")
@@ -82,11 +100,21 @@ func (w *Watcher) list(x context.Context, i int64) string {
 	}
 	return s
 }
-func (w *Watcher) tweet(x context.Context, m chan<- message, t *twitter.TweetObj) {
+func (w *Watcher) tweet(x context.Context, t post) {
 	i, _ := strconv.ParseInt(t.AuthorID, 10, 64)
 	if i == 0 {
 		return
 	}
+	p, _ := strconv.ParseUint(t.ID, 10, 64)
+	if p == 0 || w.seen.has(p) {
+		w.with(fields{"tweet_id": t.ID, "author": t.Source}).Debug(
+			`Tweet "twitter.com/%s/status/%s" was already handled, skipping it!`, t.Source, t.ID,
+		)
+		return
+	}
+	// NOTE(dij): Duplicates are checked per chat, and the Tweet is only marked
+	//            as handled once every chat got it. A failed lookup leaves it
+	//            for the next copy from backfill or polling.
 	r, err := w.sql.QueryContext(x, "notify", i)
 	if err != nil {
 		w.log.Error("Error getting Twitter subscriptions from database: %s!", err.Error())
@@ -98,6 +126,9 @@ func (w *Watcher) tweet(x context.Context, m chan<- message, t *twitter.TweetObj
 		v = strings.ToLower(t.Text)
 		s = "Tweet from @" + t.Source + "!\n\n" + t.Text + "\n\nhttps://twitter.com/" + t.Source + "/status/" + t.ID
 	)
+	if t.late {
+		s = "Late " + s
+	}
 	for r.Next() {
 		if err := r.Scan(&c, &k); err != nil {
 			w.log.Error("Error scanning data into Twitter subscriptions from database: %s!", err.Error())
@@ -106,126 +137,456 @@ func (w *Watcher) tweet(x context.Context, m chan<- message, t *twitter.TweetObj
 		if c == 0 {
 			continue
 		}
-		w.log.Trace(`Received Tweet "twitter.com/%s/status/%s", match on Chat %d (Keywords: %t).`, t.Source, t.ID, c, k.Valid)
-		if !k.Valid || (k.Valid && stringSplitContainsNLA(v, k.String)) {
-			w.log.Debug(`Sending Telegram update for Tweet "twitter.com/%s/status/%s" to chat %d..`, t.Source, t.ID, c)
-			m <- message{tries: 2, msg: telegram.NewMessage(c, s)}
+		l := w.with(fields{"chat_id": c, "tweet_id": t.ID, "author": t.Source})
+		if !w.claim(x, c, p) {
+			l.Debug(`Tweet "twitter.com/%s/status/%s" was already handled for chat %d, skipping it!`, t.Source, t.ID, c)
 			continue
 		}
-		w.log.Trace(`Skipping Telegram update for Tweet "twitter.com/%s/status/%s" to %d as it does not match keywords!`, t.Source, t.ID, c)
+		l.Trace(`Received Tweet "twitter.com/%s/status/%s", match on Chat %d (Keywords: %t).`, t.Source, t.ID, c, k.Valid)
+		ok, e := true, "there are no keywords"
+		if k.Valid {
+			ok, e = stringSplitContainsNLA(v, k.String)
+		}
+		if ok {
+			l.Debug(`Sending Telegram update for Tweet "twitter.com/%s/status/%s" to chat %d..`, t.Source, t.ID, c)
+			w.record(x, c, t.TweetObj, deliveryQueued, e)
+			w.deliver(x, message{tries: 2, chat: c, post: t.ID, msg: telegram.NewMessage(c, s)})
+			continue
+		}
+		w.record(x, c, t.TweetObj, deliveryFiltered, e)
+		atomic.AddUint64(&w.stats.now.filtered, 1)
+		atomic.AddUint64(&w.metrics.dropped, 1)
+		l.Trace(`Skipping Telegram update for Tweet "twitter.com/%s/status/%s" to %d as it does not match keywords!`, t.Source, t.ID, c)
 	}
-	r.Close()
-}
-func (w *Watcher) message(x context.Context, n *telegram.Message, c chan<- uint8) string {
-	if len(n.From.UserName) == 0 || !canUseACL(n.From.UserName, w.allowed, w.blocked) {
-		return `I'm sorry but my permissions do not allow you to use this service.`
+	if r.Close(); r.Err() != nil {
+		w.log.Error("Error reading Twitter subscriptions from database: %s!", r.Err().Error())
+		return
 	}
-	_, ok := w.confirm[n.Chat.ID]
-	if delete(w.confirm, n.Chat.ID); ok && stringLowMatch(n.Text, "confirm") {
-		if r := w.clear(x, n.Chat.ID); !r {
-			return errmsg
+	w.handled(x, i, p)
+}
+func (w *Watcher) message(x context.Context, n *telegram.Message, o *telegram.MessageConfig, m chan<- message, c chan<- uint8) string {
+	r := w.role(x, n.From)
+	if r < roleUser {
+		// NOTE(dij): Unknown users can redeem an invite code from a deep link
+		//            which comes in as "/start <code>".
+		if r == roleBanned || len(n.Text) < 8 || !strings.EqualFold(n.Text[:7], "/start ") {
+			return denied
 		}
-		c <- 0
-		return "Awesome! I have cleared your following list!"
+		if !w.redeem(x, n.From.ID, strings.TrimSpace(n.Text[7:])) {
+			return `I'm sorry, but that invite code is not valid or has expired.`
+		}
+		r = roleUser
 	}
-	if len(n.Text) < 5 || n.Text[0] != '/' {
-		return invalid
+	if n.Document != nil {
+		return w.document(x, n, c)
 	}
-	d := strings.IndexByte(n.Text, ' ')
-	if d < 4 && !(n.Text[1] == 'l' || n.Text[1] == 'L' || n.Text[1] == 'c' || n.Text[1] == 'C') {
-		return invalid
+	if n.Text[0] != '/' {
+		return w.reply(x, n.Chat.ID, n.From.ID, n.Text, m, c)
 	}
+	d := strings.IndexByte(n.Text, ' ')
 	if d == -1 {
 		d = len(n.Text)
 	}
-	switch strings.ToLower(n.Text[1:d]) {
+	v := strings.ToLower(n.Text[1:d])
+	if e := strings.IndexByte(v, '@'); e > 0 {
+		// NOTE(dij): Remove the "@botname" suffix that group chats add.
+		v = v[:e]
+	}
+	a := strings.TrimSpace(n.Text[d:])
+	switch v {
+	case "start":
+		return w.onboard(x, n.Chat.ID, o)
+	case "list":
+		return w.list(x, n.Chat.ID)
 	case "clear":
-		w.confirm[n.Chat.ID] = confirm
-		return `Please reply with "confirm" in order to clear your list.`
-	case "add", "list", "remove":
-	default:
+		return w.prompt(x, n.Chat.ID, o)
+	case "cancel":
+		w.endState(x, n.Chat.ID)
+		return "Alright, I have cancelled any pending requests."
+	case "keywords":
+		if len(a) == 0 {
+			return invalid
+		}
+		return w.keywords(x, n.Chat.ID, a, o)
+	case "export":
+		return w.export(x, n.Chat.ID, a, m)
+	case "import":
+		if n.ReplyToMessage != nil && n.ReplyToMessage.Document != nil {
+			return w.load(x, n.Chat.ID, n.From.ID, n.ReplyToMessage.Document, c)
+		}
+		return w.upload(x, n.Chat.ID, o)
+	case "import_following", "import_list":
+		if len(a) == 0 {
+			return invalid
+		}
+		return w.following(x, n.Chat.ID, n.From.ID, a, v[7] == 'l', m, c)
+	case "why":
+		if len(a) == 0 {
+			return invalid
+		}
+		return w.why(x, n.Chat.ID, a)
+	case "pause", "resume":
+		return w.pause(x, n.Chat.ID, a, v[0] == 'p')
+	case "add", "remove":
+		if len(a) == 0 {
+			return invalid
+		}
+		return w.action(x, n.Chat.ID, n.From.ID, a, v[0] == 'a', o, c)
+	case "broadcast":
+		if r != roleAdmin {
+			break
+		}
+		if len(a) == 0 {
+			return invalid + admins
+		}
+		return w.announce(x, n.Chat.ID, a, o)
+	case "stats":
+		if r != roleAdmin {
+			break
+		}
+		return w.statistics(x)
+	case "users", "invite", "audit", "allow", "ban", "quota":
+		if r != roleAdmin {
+			break
+		}
+		if len(a) == 0 && v != "users" && v != "invite" && v != "audit" {
+			return invalid + admins
+		}
+		return w.admin(x, n.From.ID, v, a)
+	}
+	if r == roleAdmin {
+		return invalid + admins
+	}
+	return invalid
+}
+func (w *Watcher) document(x context.Context, n *telegram.Message, c chan<- uint8) string {
+	if v := strings.TrimSpace(strings.ToLower(n.Caption)); strings.HasPrefix(v, "/import") {
+		return w.load(x, n.Chat.ID, n.From.ID, n.Document, c)
+	}
+	s, err := w.getState(x, n.Chat.ID)
+	if err != nil {
+		w.log.Error("Error getting conversation state for chat %d from database: %s!", n.Chat.ID, err.Error())
+		return errmsg
+	}
+	if s.action != stateImport {
 		return invalid
 	}
-	if n.Text[1] == 'l' || n.Text[1] == 'L' {
-		return w.list(x, n.Chat.ID)
+	return w.load(x, n.Chat.ID, n.From.ID, n.Document, c)
+}
+func (w *Watcher) quota(x context.Context, u int64) (limits, error) {
+	r, ok := w.sql.QueryRowContext(x, "quota_get", u)
+	if !ok {
+		return w.limits, sql.ErrConnDone
+	}
+	var (
+		q    = w.limits
+		s, k sql.NullInt64
+	)
+	switch err := r.Scan(&s, &k); err {
+	case nil:
+	case sql.ErrNoRows:
+		return q, nil
+	default:
+		return q, err
+	}
+	if s.Valid {
+		q.Subscriptions = int(s.Int64)
 	}
-	return w.action(x, n.Chat.ID, n.Text[d+1:], n.Text[1] == 'a' || n.Text[1] == 'A', c)
+	if k.Valid && k.Int64 > 0 && k.Int64 <= 256 {
+		q.Keywords = int(k.Int64)
+	}
+	return q, nil
+}
+func (w *Watcher) limited(err error, q limits) string {
+	switch err {
+	case errQuotaChat:
+		return "I'm sorry, but you can only follow up to " + strconv.Itoa(q.Subscriptions) + " users in this chat!"
+	case errQuotaTotal:
+		return "I'm sorry, but I am already following as many users as I can! Please ask an administrator for help."
+	}
+	return ""
 }
-func (w *Watcher) action(x context.Context, i int64, s string, a bool, c chan<- uint8) string {
+func (w *Watcher) subscribe(x context.Context, i, u int64, n string, t int64, k sql.NullString, q limits) (bool, error) {
+	if q.Subscriptions > 0 || q.Mappings > 0 {
+		v, ok := w.sql.QueryRowContext(x, "quota", i, i, t, t, n, t, t, n)
+		if !ok {
+			return false, sql.ErrConnDone
+		}
+		var s, t, e, f int
+		if err := v.Scan(&s, &t, &e, &f); err != nil {
+			return false, err
+		}
+		if q.Subscriptions > 0 && e == 0 && s >= q.Subscriptions {
+			return false, errQuotaChat
+		}
+		if q.Mappings > 0 && f == 0 && t >= q.Mappings {
+			return false, errQuotaTotal
+		}
+	}
+	var (
+		r   *sql.Rows
+		err error
+	)
+	if t > 0 {
+		r, err = w.sql.QueryContext(x, "add_id", i, t, n, k, u)
+	} else {
+		r, err = w.sql.QueryContext(x, "add", i, n, k, u)
+	}
+	if err != nil {
+		return false, err
+	}
+	var (
+		v bool
+		m int64
+	)
+	for !v && r.Next() {
+		if r.Scan(&m); m == 0 {
+			v = true
+		}
+	}
+	r.Close()
+	return v, nil
+}
+func (w *Watcher) action(x context.Context, i, z int64, s string, a bool, o *telegram.MessageConfig, c chan<- uint8) string {
 	if p := strings.IndexByte(s, ','); p == -1 && !a {
 		switch strings.ToLower(strings.TrimSpace(s)) {
 		case "all", "clear":
-			w.confirm[i] = confirm
-			return `Please reply with "confirm" in order to clear your list.`
+			return w.prompt(x, i, o)
 		}
 	}
 	n, k, msg := split(strings.TrimSpace(s))
 	if len(msg) > 0 {
 		return msg
 	}
-	if len(k) > 256 {
-		w.log.Warning("User %d: Invalid keyword size specified %d, must be less than 256!", i, len(k))
-		return `I'm sorry, but keyword lists must be under 256 characters!`
+	q, err := w.quota(x, z)
+	if err != nil {
+		w.log.Error("Error getting quota for user %d from database: %s!", z, err.Error())
+		return errmsg
+	}
+	if len(k) > q.Keywords {
+		w.log.Warning("User %d: Invalid keyword size specified %d, must be less than %d!", i, len(k), q.Keywords)
+		return `I'm sorry, but keyword lists must be under ` + strconv.Itoa(q.Keywords) + ` characters!`
 	}
 	if !a {
 		for p := range n {
-			if _, err := w.sql.ExecContext(x, "del", i, n[p]); err != nil {
-				w.log.Error("Error deleting Twitter subscription entry from database: %s!", err.Error())
+			d, _, err := w.mapped(x, i, n[p])
+			if err != nil {
+				w.log.Error("Error getting Twitter subscription from database: %s!", err.Error())
+				return errmsg
+			}
+			if d == 0 {
+				continue
+			}
+			if _, err = w.sql.ExecContext(x, "del", i, d, z); err != nil {
+				w.with(fields{"chat_id": i, "user_id": z, "author": n[p]}).Error("Error deleting Twitter subscription entry from database: %s!", err.Error())
 				return errmsg
 			}
 		}
 		c <- 0
-		return "Awesome! Your following list was updated!"
+		return updated
+	}
+	// NOTE(dij): Usernames can be taken by someone else after a rename, so the
+	//            users are looked up first and followed by their account ID. If
+	//            Twitter can't be reached, usernames are added as-is and resolved
+	//            later, but account IDs can't be.
+	f, err := w.identify(x, n)
+	if err != nil {
+		w.log.Warning("Error looking up Twitter users, adding them by username: %s!", err.Error())
+		for p := range n {
+			if strings.HasPrefix(n[p], "id:") {
+				return "I'm sorry, but I can't look up Twitter account IDs right now! Please try again later or use the username instead."
+			}
+		}
 	}
 	var (
 		e = sql.NullString{Valid: len(k) > 0, String: k}
 		u bool
-		m int64
+		d int
 	)
 	for p := range n {
-		r, err := w.sql.QueryContext(x, "add", i, n[p], e)
+		var (
+			v = n[p]
+			t int64
+		)
+		if o, ok := f[strings.ToLower(n[p])]; ok {
+			v = o.UserName
+			t, _ = strconv.ParseInt(o.ID, 10, 64)
+		} else if strings.HasPrefix(n[p], "id:") {
+			msg = "I'm sorry, but I couldn't find a Twitter account with the ID " + n[p][3:] + "!"
+			break
+		}
+		r, err := w.subscribe(x, i, z, v, t, e, q)
 		if err != nil {
-			w.log.Error("Error adding Twitter subscription entry to database: %s!", err.Error())
+			if msg = w.limited(err, q); len(msg) > 0 {
+				break
+			}
+			w.with(fields{"chat_id": i, "user_id": z, "author": n[p]}).Error("Error adding Twitter subscription entry to database: %s!", err.Error())
 			return errmsg
 		}
-		for !u && r.Next() {
-			if u {
-				break
+		u = u || r
+		d++
+	}
+	switch {
+	case d == 0:
+	case u:
+		c <- 1
+	default:
+		c <- 0
+	}
+	if len(msg) > 0 {
+		if d > 0 {
+			return msg + "\n\nI was able to add the first " + strconv.Itoa(d) + " users from your list."
+		}
+		return msg
+	}
+	return updated
+}
+
+// mapped returns the mapping ID and username of the chat subscription for the
+// username or "id:" prefixed account ID, or zero if it isn't followed. Names
+// can be shared after a rename, so the current account is picked first.
+func (w *Watcher) mapped(x context.Context, i int64, s string) (int64, string, error) {
+	var t int64
+	if strings.HasPrefix(s, "id:") {
+		t, _ = strconv.ParseInt(s[3:], 10, 64)
+	}
+	r, ok := w.sql.QueryRowContext(x, "sub_find", i, t, t, s)
+	if !ok {
+		return 0, "", sql.ErrConnDone
+	}
+	var (
+		d int64
+		n string
+	)
+	if err := r.Scan(&d, &n); err != nil && err != sql.ErrNoRows {
+		return 0, "", err
+	}
+	return d, n, nil
+}
+func (w *Watcher) unsubscribe(x context.Context, i, u int64, s string, c chan<- uint8) string {
+	t, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || t <= 0 {
+		return expired
+	}
+	d, n, err := w.mapped(x, i, "id:"+s)
+	if err != nil {
+		w.log.Error("Error getting Twitter subscription from database: %s!", err.Error())
+		return errmsg
+	}
+	if d == 0 {
+		return "I'm not following that user for you anymore."
+	}
+	if _, err = w.sql.ExecContext(x, "del", i, d, u); err != nil {
+		w.with(fields{"chat_id": i, "user_id": u, "author": n}).Error("Error deleting Twitter subscription entry from database: %s!", err.Error())
+		return errmsg
+	}
+	c <- 0
+	return "Alright, I have stopped following @" + n + " for you."
+}
+func (w *Watcher) pause(x context.Context, i int64, s string, p bool) string {
+	var (
+		n    []string
+		k    string
+		d    sql.NullInt64
+		q    = "resume"
+		msg  string
+		v, e = s, strings.IndexByte(s, ' ')
+	)
+	if e > 0 {
+		v, k = s[:e], strings.TrimSpace(s[e+1:])
+	}
+	switch {
+	case len(v) == 0 || stringLowMatch(v, "all"):
+	case v[0] == '@' || strings.HasPrefix(strings.ToLower(v), "id:"):
+		if n, _, msg = split(v); len(msg) > 0 {
+			return msg
+		}
+	case p && len(k) == 0:
+		// NOTE(dij): A single non-username argument is the duration for all.
+		k = v
+	default:
+		return invalid
+	}
+	if p {
+		if q = "pause"; len(k) > 0 {
+			t, ok := parseDuration(k)
+			if !ok {
+				return `I'm sorry, but "` + k + `" is not a valid duration!` + "\n\nDurations look like \"30m\", \"12h\" or \"7d\"."
 			}
-			if r.Scan(&m); m == 0 {
-				u = true
-				break
+			d.Int64, d.Valid = int64(t.Seconds()), true
+		}
+	}
+	if len(n) == 0 {
+		var err error
+		if p {
+			_, err = w.sql.ExecContext(x, "pause_all", d, i)
+		} else {
+			_, err = w.sql.ExecContext(x, "resume_all", i)
+		}
+		if err != nil {
+			w.log.Error("Error updating Twitter subscription pause state in database: %s!", err.Error())
+			return errmsg
+		}
+		if p {
+			return "Awesome! I have paused all of your subscriptions!"
+		}
+		return "Awesome! I have resumed all of your subscriptions!"
+	}
+	var b []string
+	for z := range n {
+		u, _, err := w.mapped(x, i, n[z])
+		if err != nil {
+			w.log.Error("Error getting Twitter subscription from database: %s!", err.Error())
+			return errmsg
+		}
+		if u == 0 {
+			if !strings.HasPrefix(n[z], "id:") {
+				n[z] = "@" + n[z]
 			}
+			b = append(b, n[z])
+			continue
+		}
+		if p {
+			_, err = w.sql.ExecContext(x, q, d, i, u)
+		} else {
+			_, err = w.sql.ExecContext(x, q, i, u)
+		}
+		if err != nil {
+			w.log.Error("Error updating Twitter subscription pause state in database: %s!", err.Error())
+			return errmsg
 		}
-		r.Close()
 	}
-	if u {
-		c <- 1
+	if len(b) > 0 {
+		return "I'm not following " + strings.Join(b, ", ") + " for you, but I have updated the rest of your list."
+	}
+	return updated
+}
+func (w *Watcher) answer(x context.Context, m chan<- message, q *telegram.CallbackQuery, c chan<- uint8) {
+	if _, err := w.bot.Request(telegram.NewCallback(q.ID, "")); err != nil {
+		w.log.Warning("Error answering Telegram callback query from %s: %s!", q.From.String(), err.Error())
+	}
+	if q.Message == nil || q.Message.Chat == nil {
+		return
+	}
+	w.with(fields{"chat_id": q.Message.Chat.ID, "user_id": q.From.ID}).Trace(
+		"Received Telegram callback query from %s (%d).", q.From.String(), q.Message.Chat.ID,
+	)
+	var s string
+	if w.role(x, q.From) < roleUser {
+		s = denied
 	} else {
-		c <- 0
+		s = w.callback(x, q, m, c)
 	}
-	return "Awesome! Your following list was updated!"
+	m <- message{tries: 2, chat: q.Message.Chat.ID, msg: telegram.NewEditMessageText(q.Message.Chat.ID, q.Message.MessageID, s)}
 }
-func (w *Watcher) send(x context.Context, g *sync.WaitGroup, m chan message, t <-chan *twitter.TweetObj) {
+func (w *Watcher) send(x context.Context, g *sync.WaitGroup, m chan message, t <-chan post) {
 	w.log.Info("Starting Telegram sender thread..")
 	for g.Add(1); ; {
 		select {
 		case n := <-t:
-			w.tweet(x, m, n)
+			w.tweet(x, n)
 		case n := <-m:
-			_, err := w.bot.Send(n.msg)
-			if err == nil {
-				break
-			}
-			w.log.Warning(`Error sending Telegram message to "%d": %s!`, n.msg.ChatID, err.Error())
-			if n.tries <= 1 {
-				w.log.Error(`Removing Telegram message to "%d": Send failed too many times!`, n.msg.ChatID)
-				break
-			}
-			n.tries = n.tries - 1
-			w.log.Debug("Sleeping for %s to Telegram prevent rate-limiting!", w.backoff.String())
-			time.Sleep(w.backoff)
-			m <- n
+			w.deliver(x, n)
 		case <-x.Done():
 			w.log.Info("Stopping Telegram sender thread.")
 			g.Done()
@@ -233,16 +594,62 @@ func (w *Watcher) send(x context.Context, g *sync.WaitGroup, m chan message, t <
 		}
 	}
 }
+
+// deliver sends the message to Telegram, waiting and retrying in place when it
+// fails. This never writes back to the message queue, as the sender thread is
+// the only thread that reads from it.
+func (w *Watcher) deliver(x context.Context, n message) {
+	for {
+		_, err := w.bot.Send(n.msg)
+		if err == nil {
+			if len(n.post) > 0 {
+				w.delivered(x, n.chat, n.post, deliverySent)
+				atomic.AddUint64(&w.stats.now.delivered, 1)
+			}
+			return
+		}
+		w.metrics.sendError(err)
+		l := w.with(fields{"chat_id": n.chat, "tweet_id": n.post, "attempt": 3 - int(n.tries)})
+		l.Warning(`Error sending Telegram message to "%d": %s!`, n.chat, err.Error())
+		if n.tries <= 1 {
+			if l.Error(`Removing Telegram message to "%d": Send failed too many times!`, n.chat); len(n.post) > 0 {
+				w.delivered(x, n.chat, n.post, deliveryFailed)
+				atomic.AddUint64(&w.stats.now.failed, 1)
+			}
+			return
+		}
+		n.tries = n.tries - 1
+		l.Debug("Sleeping for %s to Telegram prevent rate-limiting!", w.backoff.String())
+		select {
+		case <-time.After(w.backoff):
+		case <-x.Done():
+			return
+		}
+	}
+}
 func (w *Watcher) receive(x context.Context, g *sync.WaitGroup, m chan<- message, r <-chan telegram.Update, c chan<- uint8) {
 	w.log.Info("Starting Telegram receiver thread..")
 	for g.Add(1); ; {
 		select {
 		case n := <-r:
-			if n.Message == nil || n.Message.Chat == nil || len(n.Message.Text) == 0 {
+			if n.CallbackQuery != nil {
+				w.answer(x, m, n.CallbackQuery, c)
+				break
+			}
+			if n.Message == nil || n.Message.Chat == nil || n.Message.From == nil {
+				break
+			}
+			if len(n.Message.Text) == 0 && n.Message.Document == nil {
+				break
+			}
+			w.with(fields{"chat_id": n.Message.Chat.ID, "user_id": n.Message.From.ID}).Trace(
+				"Received Telegram message from %s (%d).", n.Message.From.String(), n.Message.Chat.ID,
+			)
+			o := telegram.NewMessage(n.Message.Chat.ID, "")
+			if o.Text = w.message(x, n.Message, &o, m, c); len(o.Text) == 0 {
 				break
 			}
-			w.log.Trace("Received Telegram message from %s (%d).", n.Message.From.String(), n.Message.Chat.ID)
-			m <- message{tries: 2, msg: telegram.NewMessage(n.Message.Chat.ID, w.message(x, n.Message, c))}
+			m <- message{tries: 2, chat: n.Message.Chat.ID, msg: o}
 		case <-x.Done():
 			w.log.Info("Stopping Telegram receiver thread.")
 			g.Done()
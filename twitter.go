@@ -18,38 +18,25 @@ package watcher
 
 import (
 	"context"
-	"encoding/json"
 	"html"
-	"net"
-	"net/http"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	twitter "github.com/g8rswimmer/go-twitter/v2"
 )
 
-const (
-	drop  = time.Minute
-	pause = time.Second * 5
-)
+const pause = time.Second * 5
 
-type token struct {
-	_     [0]func()
-	Type  string `json:"token_type"`
-	Token string `json:"access_token"`
-}
-type mapping struct {
-	_       [0]func()
-	New     string
-	Name    string
-	Twitter string
-	ID      int64
-	TID     int64
-	Update  bool
+type post struct {
+	*twitter.TweetObj
+	late bool
 }
 
+func isReply(v *twitter.TweetObj) bool {
+	return (len(v.Text) > 0 && v.Text[0] == '@') || len(v.InReplyToUserID) > 0 || len(v.ReferencedTweets) > 0
+}
 func parseTweetText(v *twitter.TweetObj, t *twitter.TweetRaw) string {
 	s := html.UnescapeString(v.Text)
 	if v.Entities == nil {
@@ -60,238 +47,190 @@ func parseTweetText(v *twitter.TweetObj, t *twitter.TweetRaw) string {
 	}
 	return s
 }
-func (w *Watcher) resolve(x context.Context, t *twitter.Client, a bool) {
-	w.log.Info("Starting Twitter ID mapping resolve task..")
-	r, err := w.sql.QueryContext(x, "get_all")
-	if err != nil {
-		w.log.Error("Error getting Twitter mappings from database: %s!", err.Error())
-		return
-	}
+func (w *Watcher) watch(x context.Context, g *sync.WaitGroup, u *shard, q chan<- message, o chan<- post) {
 	var (
-		l       = make([]*mapping, 0, 64)
-		s       string
-		c, m, u int64
+		t = u.api
+		c = u.c
+		z = make(chan *twitter.TweetMessage)
+		h = time.NewTicker(heartbeat)
+		p = time.NewTicker(w.every)
+		y = time.NewTimer(time.Hour)
+		k = make(rules)
+		r <-chan *twitter.TweetMessage
+		m <-chan map[twitter.SystemMessageType]twitter.SystemMessage
+		e <-chan *twitter.DisconnectionError
+		l chan struct{}
+		s *twitter.TweetStream
+		v []string
+		b backoff
+		n backoff
+		f error
+		i uint8
+		d uint8
+		j bool
+		a bool
 	)
-	for r.Next() {
-		if err = r.Scan(&c, &m, &s, &u); err != nil {
-			w.log.Error("Error scanning data into Twitter mappings from database: %s!", err.Error())
-			continue
-		}
-		if !a && u != 0 || len(s) == 0 {
-			continue
-		}
-		if cap(l) < int(c) {
-			l = append(make([]*mapping, 0, int(c)-cap(l)), l...)
+	// NOTE(dij): y is the reconnect timer, it's started once there are rules
+	//            to stream and j is true while it's waiting. a is true once
+	//            the account has logged in. l is set while resolve is running
+	//            and d is any resolve asked for in the meantime.
+	g.Add(1)
+	y.Stop()
+	if f = u.acct.login(x); f != nil {
+		if len(w.shards) == 1 {
+			w.log.Error("Error logging in to Twitter: %s!", f.Error())
+			w.fatal(f)
+			goto done
 		}
-		l = append(l, &mapping{ID: m, TID: u, Name: s, Twitter: strconv.FormatInt(u, 10)})
+		w.with(fields{"account": u.id}).Error("Error logging in to Twitter: %s!", f.Error())
+		j = true
+		w.mark(u, false)
+		y.Reset(w.retry(u, &b, failHTTP, time.Time{}))
+	} else {
+		a = true
 	}
-	if r.Close(); len(l) == 0 {
-		w.log.Debug("Twitter resolve mapping is empty, not attempting to resolve..")
-		return
+	// NOTE(dij): Only the first shard resolves the usernames at startup, the
+	//            others only have to follow what's already in the database.
+	if u.id == 0 {
+		i = 2
 	}
-	var (
-		i    = make(map[string]string, len(l))
-		p, n []string
-	)
-	w.log.Debug("Twitter mapping generated, attempting to resolve to %d user IDs..", len(l))
-	for q, z := 0, 0; q < len(l); q += 50 {
-		if z = q + 50; z > len(l) {
-			z = len(l)
-		}
-		n = make([]string, 0, z-q)
-		for _, v := range l[q:z] {
-			n = append(n, v.Name)
-		}
-		for _, v := range l[q:z] {
-			p = append(p, v.Twitter)
-		}
-		r, err := t.UserNameLookup(x, n, twitter.UserLookupOpts{UserFields: []twitter.UserField{twitter.UserFieldID, twitter.UserFieldUserName}})
-		if err != nil {
-			w.log.Error("Error retrieving data about Twitter mappings from Twitter: %s!", err.Error())
-			continue
-		}
-		if r.Raw == nil || len(r.Raw.Users) == 0 {
-			// Mapping returned no results.
-			continue
-		}
-		for v := range r.Raw.Users {
-			if r.Raw.Users[v] == nil {
-				// Invalid user entry
-				continue
-			}
-			if _, ok := i[r.Raw.Users[v].ID]; ok {
-				w.log.Warning(`Duplicate ID value "%s" detected with username "%s"!`, r.Raw.Users[v].ID, r.Raw.Users[v].UserName)
-			}
-			i[r.Raw.Users[v].ID] = r.Raw.Users[v].UserName
-		}
-		r, err = t.UserLookup(x, p, twitter.UserLookupOpts{UserFields: []twitter.UserField{twitter.UserFieldID, twitter.UserFieldName, twitter.UserFieldUserName}})
-		if err != nil {
-			w.log.Error("Error retrieving data about Twitter mappings from Twitter: %s!", err.Error())
-			continue
-		}
-		if r.Raw == nil || len(r.Raw.Users) == 0 {
-			// Mapping returned no results.
-			continue
-		}
-		for v := range r.Raw.Users {
-			if r.Raw.Users[v] == nil {
-				// Invalid user entry
-				continue
-			}
-			// We don't need to check for duplicates here.
-			i[r.Raw.Users[v].ID] = r.Raw.Users[v].UserName
-		}
+	w.with(fields{"account": u.id}).Info("Starting Twitter stream thread..")
+	if i > 0 {
+		<-w.background(x, q, i)
 	}
-	for k, v := range i {
-		for x := range l {
-			if len(l[x].Twitter) > 0 && l[x].Twitter == k && !stringLowMatch(v, l[x].Name) {
-				if l[x].New, l[x].Update = v, true; l[x].TID == 0 {
-					l[x].TID, _ = strconv.ParseInt(k, 10, 64)
-				}
-				w.log.Warning(`Found new name for ID "%s": %s => %s!`, k, l[x].Name, l[x].New)
-				continue
-			}
-			if !stringLowMatch(v, l[x].Name) {
-				continue
-			}
-			if l[x].TID == 0 || len(l[x].Twitter) == 0 {
-				l[x].TID, _ = strconv.ParseInt(k, 10, 64)
-				l[x].Update, l[x].Twitter = true, k
-			}
-			w.log.Trace(`Twitter username %s (db: %s) was resolved to "%s".`, v, l[x].Name, k)
-		}
-	}
-	for x := range l {
-		if !l[x].Update {
-			continue
-		}
-		if len(l[x].New) > 0 {
-			_, err = w.sql.Exec("set", l[x].ID, uint64(l[x].TID), l[x].New)
-		} else {
-			_, err = w.sql.Exec("set", l[x].ID, uint64(l[x].TID), l[x].Name)
+	if v, f = w.update(x, u, k); f != nil {
+		if u.id == 0 {
+			w.log.Error("Error creating initial Twitter stream rules: %s!", f.Error())
+			w.fatal(f)
+			goto done
 		}
-		if err != nil {
-			w.log.Error("Error updating Twitter mappings in the database: %s!", err.Error())
-			continue
+		// NOTE(dij): Other shards can fail without stopping the Watcher, their
+		//            users are moved until they connect.
+		w.with(fields{"account": u.id}).Error("Error creating initial Twitter stream rules: %s!", f.Error())
+		if w.again(u, n.next(failure(f))); !j {
+			j = true
+			w.mark(u, false)
+			y.Reset(w.retry(u, &b, failHTTP, time.Time{}))
 		}
 	}
-	w.log.Debug("Completed Twitter ID mapping resolve task!")
-}
-func (w *Watcher) setupAuth(x context.Context, t *twitter.Client) error {
-	r, _ := http.NewRequestWithContext(x, "POST", "https://api.twitter.com/oauth2/token", strings.NewReader("grant_type=client_credentials"))
-	r.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
-	r.SetBasicAuth(w.ck, w.cs)
-	o, err := t.Client.Do(r)
-	if err != nil {
-		return err
-	}
-	var i token
-	err = json.NewDecoder(o.Body).Decode(&i)
-	if o.Body.Close(); err != nil {
-		return err
+	if w.overflow(x, q, u, nil, v); a && !j && len(k) > 0 {
+		j = true
+		y.Reset(0)
 	}
-	w.auth = i.Token
-	return nil
-}
-func (w *Watcher) watch(x context.Context, g *sync.WaitGroup, c chan uint8, o chan<- *twitter.TweetObj) {
-	t := &twitter.Client{
-		Host: "https://api.twitter.com",
-		Client: &http.Client{
-			Transport: &http.Transport{
-				DialContext:           (&net.Dialer{Timeout: time.Second * 10, KeepAlive: time.Second * 30}).DialContext,
-				MaxIdleConns:          256,
-				IdleConnTimeout:       time.Second * 60,
-				DisableKeepAlives:     false,
-				ForceAttemptHTTP2:     true,
-				TLSHandshakeTimeout:   time.Second * 10,
-				ExpectContinueTimeout: time.Second * 10,
-				ResponseHeaderTimeout: time.Second * 10,
-			},
-		},
-		Authorizer: w,
-	}
-	if w.err = w.setupAuth(x, t); w.err != nil {
-		w.log.Error("Error logging in using OAUTHv2: %s!", w.err.Error())
-		w.cancel()
-		return
-	}
-	var (
-		z = make(chan *twitter.TweetMessage)
-		y = time.NewTicker(drop)
-		r <-chan *twitter.TweetMessage
-		m <-chan map[twitter.SystemMessageType]twitter.SystemMessage
-		e <-chan *twitter.DisconnectionError
-		i int8
-		d bool
-	)
-	w.log.Info("Starting Twitter stream thread..")
-	s, k, err := w.stream(x, t, true, true)
-	if err != nil {
-		w.log.Error("Error creating initial Twitter stream: %s!", err.Error())
-		w.err = err
-		goto done
-	}
-	if s != nil {
-		r, m, e = s.Tweets(), s.SystemMessages(), s.DisconnectionError()
-	} else {
-		r, m, e = z, nil, nil
-	}
-	for g.Add(1); ; {
+	r = z
+	u.set(nil)
+	for {
 		select {
-		case <-e:
-			w.log.Error("Twitter stream thread received a StreamDisconnect message!")
-			w.log.Info("Waiting %s before retrying..", pause.String())
-			if time.Sleep(pause); len(c) == 0 {
-				d = false // Remove any backoffs beforehand, since they don't matter,
-				c <- 0
+		case d := <-e:
+			atomic.AddUint64(&w.metrics.reconnects, 1)
+			w.with(fields{"account": u.id}).Error("Twitter stream thread received a StreamDisconnect message!")
+			if d != nil {
+				for _, i := range d.Disconnections {
+					if i == nil {
+						continue
+					}
+					w.with(fields{"account": u.id}).Warning("Twitter stream was disconnected: %s (%s)!", i.Title, i.Detail)
+				}
 			}
-			w.log.Debug("Wait complete, retrying!")
+			// NOTE(dij): The rules are kept by Twitter, so only the connection
+			//            needs to be re-created.
+			s.Close()
+			s, r, m, e = nil, z, nil, nil
+			atomic.StoreInt32(&u.stream, streamDisconnected)
+			j = true
+			y.Reset(w.retry(u, &b, disconnect(d), time.Time{}))
 		case <-y.C:
-			if !d {
+			if j = false; atomic.LoadInt32(&u.breaker) == breakerOpen {
+				atomic.StoreInt32(&u.breaker, breakerHalf)
+				w.with(fields{"account": u.id}).Info("Twitter stream circuit breaker is half-open, trying to reconnect..")
+			}
+			if !a {
+				if err := u.acct.login(x); err != nil {
+					w.with(fields{"account": u.id}).Error("Error logging in to Twitter: %s!", err.Error())
+					f, l := failure(err)
+					j = true
+					y.Reset(w.retry(u, &b, f, l))
+					break
+				}
+				a = true
+			}
+			n, err := w.connect(x, t)
+			if err != nil {
+				w.with(fields{"account": u.id}).Error("Error connecting to the Twitter stream: %s!", err.Error())
+				f, l := failure(err)
+				j = true
+				y.Reset(w.retry(u, &b, f, l))
 				break
 			}
-			if d = false; i >= 0 {
-				c <- uint8(i)
+			if atomic.SwapInt32(&u.breaker, breakerClosed) != breakerClosed {
+				w.with(fields{"account": u.id}).Info("Twitter stream circuit breaker is closed.")
 			}
-			i = -1
-			w.log.Debug("Drop complete, I can now accept more requests.")
+			s = n
+			r, m, e = s.Tweets(), s.SystemMessages(), s.DisconnectionError()
+			b.reset()
+			u.set(s)
+			w.mark(u, true)
+			w.with(fields{"account": u.id}).Info("Connected to the Twitter stream.")
+			w.backfill(x, u, o, k)
+		case <-h.C:
+			// NOTE(dij): A dead connection does not always send a disconnect
+			//            message, so reconnect when the keep-alives stop.
+			if s == nil || time.Since(time.Unix(0, atomic.LoadInt64(&u.beat))) < silence {
+				break
+			}
+			atomic.AddUint64(&w.metrics.reconnects, 1)
+			w.with(fields{"account": u.id}).Warning("Twitter stream has not sent a keep-alive in %s, reconnecting..", silence.String())
+			s.Close()
+			s, r, m, e = nil, z, nil, nil
+			atomic.StoreInt32(&u.stream, streamDisconnected)
+			j = true
+			y.Reset(w.retry(u, &b, failNetwork, time.Time{}))
+		case <-p.C:
+			w.poll(x, u, o, v)
 		case o := <-m:
 			if len(o) == 0 {
 				break
 			}
 			for k, v := range o {
-				w.log.Warning("Twitter stream thread received a %s message: %s!", k, v)
+				w.with(fields{"account": u.id}).Warning("Twitter stream thread received a %s message: %s!", k, v)
 			}
-		case a := <-c:
-			if d {
-				if int8(a) > i {
-					i = int8(a)
+		case i := <-c:
+			// NOTE(dij): Merge any waiting requests into this one, as a single
+			//            update covers all of them.
+			for n := len(c); n > 0; n-- {
+				if v := <-c; v > i {
+					i = v
 				}
-				w.log.Debug("Ignoring dropped request! (%d, next %d)", a, i)
-				break
 			}
-			if w.log.Info("Attempting to reload Twitter stream.."); s != nil {
-				if len(k) > 0 {
-					t.TweetSearchStreamDeleteRuleByID(x, k, false)
+			// NOTE(dij): The rules are updated once resolve is done. Any resolve
+			//            asked for while one is running is started after it.
+			switch {
+			case i > 0 && l != nil:
+				if i > d {
+					d = i
+				}
+			case i > 0:
+				l = w.background(x, q, i)
+			default:
+				if v = w.reload(x, q, u, k, &n, v); s == nil && !j && len(k) > 0 {
+					j = true
+					y.Reset(0)
 				}
-				s.Close()
-				time.Sleep(time.Millisecond * 150)
 			}
-			if s, k, w.err = w.stream(x, t, a > 0, a > 1); w.err != nil {
-				w.log.Error("Error re-creating Twitter stream: %s!", w.err.Error())
-				goto done
+		case <-l:
+			if l = nil; d > 0 {
+				l, d = w.background(x, q, d), 0
 			}
-			if s != nil {
-				r, m, e = s.Tweets(), s.SystemMessages(), s.DisconnectionError()
-			} else {
-				r, m, e = z, nil, nil
+			if v = w.reload(x, q, u, k, &n, v); s == nil && !j && len(k) > 0 {
+				j = true
+				y.Reset(0)
 			}
-			w.log.Debug("Dropping all entries on the floor until next tick!")
-			d, i = true, -1
 		case n := <-r:
-			if len(n.Raw.Tweets) == 0 {
+			if n == nil || n.Raw == nil || len(n.Raw.Tweets) == 0 {
 				break
 			}
+			u.pulse()
+			atomic.AddUint64(&w.stats.now.received, 1)
 			v := n.Raw.Tweets[0] // There isn't more than one Tweet in here mostly.
 			if a := len(n.Raw.Tweets); a > 1 {
 				w.log.Warning("Tweet container returned %d Tweets instead of just one!", a)
@@ -299,101 +238,56 @@ func (w *Watcher) watch(x context.Context, g *sync.WaitGroup, c chan uint8, o ch
 			if len(n.Raw.Includes.Users) > 0 { // First user is usually the author.
 				v.Source = n.Raw.Includes.Users[0].UserName
 			}
-			w.log.Trace(
+			l := w.with(fields{"tweet_id": v.ID, "author": v.Source})
+			l.Trace(
 				`Tweet "%s" received! Details [Reply? %t, Retweet/Quote? %t, Size? %d, User? %s, URL? https://twitter.com/%s/status/%s]`,
 				v.ID, (len(v.Text) > 0 && v.Text[0] == '@') || len(v.InReplyToUserID) > 0, len(v.ReferencedTweets) > 0, len(v.Text), v.Source,
 				v.Source, v.ID,
 			)
 			if len(v.Text) == 0 {
-				w.log.Debug(`Tweet "twitter.com/%s/status/%s" is empty or just an image, skipping it!`, v.Source, v.ID)
+				l.Debug(`Tweet "twitter.com/%s/status/%s" is empty or just an image, skipping it!`, v.Source, v.ID)
+				atomic.AddUint64(&w.stats.now.filtered, 1)
 				continue
 			}
-			if v.Text[0] == '@' || len(v.InReplyToUserID) > 0 || len(v.ReferencedTweets) > 0 {
-				w.log.Debug(`Tweet "twitter.com/%s/status/%s" is a direct reply or retweet, skipping it!`, v.Source, v.ID)
+			if isReply(v) {
+				l.Debug(`Tweet "twitter.com/%s/status/%s" is a direct reply or retweet, skipping it!`, v.Source, v.ID)
+				atomic.AddUint64(&w.stats.now.filtered, 1)
 				continue
 			}
 			v.Text = parseTweetText(v, n.Raw)
-			o <- v
+			o <- post{TweetObj: v}
 		case <-x.Done():
-			w.log.Info("Stopping Twitter stream thread.")
+			w.with(fields{"account": u.id}).Info("Stopping Twitter stream thread.")
 			goto done
 		}
 	}
 done:
+	h.Stop()
+	p.Stop()
 	y.Stop()
-	if close(z); s != nil {
-		if len(k) > 0 {
-			t.TweetSearchStreamDeleteRuleByID(x, k, false)
+	atomic.StoreInt32(&u.stream, streamStopped)
+	if close(z); len(k) > 0 {
+		// NOTE(dij): The main context is already canceled here, so use a new
+		//            one to remove our rules.
+		v, f := context.WithTimeout(context.Background(), pause)
+		d := make([]twitter.TweetSearchStreamRuleID, 0, len(k))
+		for i := range k {
+			d = append(d, i)
+		}
+		if _, err := t.TweetSearchStreamDeleteRuleByID(v, d, false); err != nil {
+			w.with(fields{"account": u.id}).Error("Error removing Twitter stream rules: %s!", err.Error())
 		}
+		f()
+	}
+	if s != nil {
 		s.Close()
 	}
-	w.log.Info("Stopped Twitter stream thread.")
+	w.with(fields{"account": u.id}).Info("Stopped Twitter stream thread.")
 	w.cancel()
 	g.Done()
 }
-func (w *Watcher) stream(x context.Context, t *twitter.Client, f bool, a bool) (*twitter.TweetStream, []twitter.TweetSearchStreamRuleID, error) {
-	if f {
-		w.resolve(x, t, a)
-	}
-	r, err := w.sql.QueryContext(x, "get_list")
-	if err != nil {
-		w.log.Error("Error getting Twitter list from database: %s!", err.Error())
-		return nil, nil, err
-	}
-	var (
-		l = make([]string, 0)
-		s int64
-		c int
-	)
-	for r.Next() {
-		if err = r.Scan(&c, &s); err != nil {
-			w.log.Error("Error scanning data into Twitter list from database: %s!", err.Error())
-			break
-		}
-		if s == 0 || c == 0 {
-			continue
-		}
-		if cap(l) < c {
-			l = append(make([]string, 0, c-cap(l)), l...)
-		}
-		l = append(l, "from:"+strconv.FormatInt(s, 10))
-	}
-	if r.Close(); err != nil {
-		return nil, nil, err
-	}
-	if len(l) == 0 {
-		w.log.Info("Twitter watch list is empty, not starting Twitter stream..")
-		return nil, nil, nil
-	}
-	w.log.Info("Twitter watch list generated, subscribing to %d users.", len(l))
-	var (
-		k = make([]twitter.TweetSearchStreamRule, 0, 4)
-		b = builders.Get().(*strings.Builder)
-	)
-	for i := range l {
-		if len(l[i])+46+b.Len() >= 510 {
-			k = append(k, twitter.TweetSearchStreamRule{Value: " (" + b.String() + ") -is:retweet -is:quote -is:reply lang:en"})
-			b.Reset()
-		}
-		if b.Len() > 0 {
-			b.WriteString(" OR ")
-		}
-		b.WriteString(l[i])
-	}
-	if b.Len() > 0 {
-		k = append(k, twitter.TweetSearchStreamRule{Value: "(" + b.String() + ") -is:retweet -is:quote -is:reply lang:en"})
-	}
-	b.Reset()
-	builders.Put(b)
-	y, err := t.TweetSearchStreamAddRule(x, k, false)
-	if err != nil {
-		return nil, nil, err
-	}
-	v := make([]twitter.TweetSearchStreamRuleID, len(y.Rules))
-	for i := range y.Rules {
-		v[i] = y.Rules[i].ID
-	}
-	o, err := t.TweetSearchStream(x, twitter.TweetSearchStreamOpts{
+func (w *Watcher) connect(x context.Context, t *twitter.Client) (*twitter.TweetStream, error) {
+	return t.TweetSearchStream(x, twitter.TweetSearchStreamOpts{
 		Expansions: []twitter.Expansion{
 			twitter.ExpansionAuthorID,
 		},
@@ -409,8 +303,4 @@ func (w *Watcher) stream(x context.Context, t *twitter.Client, f bool, a bool) (
 			twitter.TweetFieldReferencedTweets,
 		},
 	})
-	if err != nil {
-		return nil, nil, err
-	}
-	return o, v, err
 }
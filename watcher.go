@@ -25,6 +25,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -41,19 +42,34 @@ import (
 type Watcher struct {
 	log     logx.Log
 	err     error
-	sql     *mapper.Map
+	sql     *database
 	bot     *telegram.BotAPI
+	stats   *stats
+	metrics *metrics
+	seen    *lru
 	tick    *time.Ticker
-	auth    string
-	ck, cs  string
+	tier    tier
+	jobs    sync.WaitGroup
+	fail    sync.Once
+	shards  []*shard
+	listen  string
+	notice  string
 	cancel  context.CancelFunc
-	confirm map[int64]struct{}
+	private bool
 	allowed []string
 	blocked []string
 	backoff time.Duration
+	expire  time.Duration
+	window  time.Duration
+	next    uint32
+	every   time.Duration
+	history time.Duration
+	limits  limits
 }
 type message struct {
-	msg   telegram.MessageConfig
+	msg   telegram.Chattable
+	post  string
+	chat  int64
 	tries uint8
 }
 
@@ -65,25 +81,40 @@ func (w *Watcher) Run() error {
 	telegram.SetLogger(w.log)
 	var (
 		r = w.bot.GetUpdatesChan(telegram.UpdateConfig{})
+		f = time.NewTicker(rollup)
 		c = make(chan uint8, 64)
 		s = make(chan os.Signal, 1)
 		m = make(chan message, 256)
-		t = make(chan *twitter.TweetObj, 256)
+		t = make(chan post, 256)
 		x context.Context
 		g sync.WaitGroup
 	)
 	signal.Notify(s, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	x, w.cancel = context.WithCancel(context.Background())
 	w.log.Info("Twitter Watcher Telegram Bot Started, spinning up threads..")
+	w.stats.start = time.Now()
+	w.stats.depth = func() (int, int, int) { return len(m), len(t), len(c) }
+	w.shards[0].c = c
 	go w.send(x, &g, m, t)
-	go w.watch(x, &g, c, t)
+	for i := range w.shards {
+		go w.watch(x, &g, w.shards[i], m, t)
+	}
 	go w.receive(x, &g, m, r, c)
+	w.serve(x, &g)
+	if len(w.notice) > 0 {
+		if _, err := w.broadcast(x, w.notice); err != nil {
+			w.log.Error("Error sending broadcast message: %s!", err.Error())
+		}
+	}
 	for {
 		select {
 		case <-s:
 			goto cleanup
 		case <-w.tick.C:
 			c <- 2
+		case <-f.C:
+			w.flush()
+			w.prune(x)
 		case <-x.Done():
 			goto cleanup
 		}
@@ -91,25 +122,36 @@ func (w *Watcher) Run() error {
 cleanup:
 	signal.Stop(s)
 	w.cancel()
+	f.Stop()
 	w.tick.Stop()
 	w.bot.StopReceivingUpdates()
 	g.Wait()
+	w.jobs.Wait()
 	close(c)
 	close(s)
 	close(m)
 	close(t)
+	w.flush()
 	if err := w.sql.Close(); err != nil {
 		return err
 	}
 	return w.err
 }
 
-// Add fulfils the Authenticator interface.
-func (w *Watcher) Add(r *http.Request) {
-	if len(w.auth) == 0 {
-		return
+// Broadcast will queue the supplied message to be sent to every chat that has a
+// subscription once the Watcher is started using the 'Run' function.
+//
+// This function returns the amount of chats that the message will be sent to.
+// If 'dry' is true, the message is not queued and only the count is returned.
+func (w *Watcher) Broadcast(s string, dry bool) (int, error) {
+	l, err := w.chats(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	if !dry {
+		w.notice = s
 	}
-	r.Header.Add("Authorization", "Bearer "+w.auth)
+	return len(l), nil
 }
 
 // New returns a new Watcher instance based on the passed config file path.
@@ -131,13 +173,9 @@ func New(s string, empty, update bool) (*Watcher, error) {
 	if err = c.check(); err != nil {
 		return nil, err
 	}
-	l := logx.Multiple(logx.Console(logx.Level(c.Log.Level)))
-	if len(c.Log.File) > 0 {
-		var f logx.Log
-		if f, err = logx.File(c.Log.File, logx.Append, logx.Level(c.Log.Level)); err != nil {
-			return nil, errors.New(`setting up log file "` + c.Log.File + `": ` + err.Error())
-		}
-		l.Add(f)
+	l, err := newLog(c.Log.File, c.Log.Format, c.Log.Level)
+	if err != nil {
+		return nil, err
 	}
 	l.SetPrintLevel(logx.Error)
 	b, err := telegram.NewBotAPIWithClient(c.Telegram, telegram.APIEndpoint, &http.Client{Transport: &http.Transport{
@@ -156,7 +194,7 @@ func New(s string, empty, update bool) (*Watcher, error) {
 	}
 	d, err := sql.Open(
 		"mysql",
-		c.Database.Username+":"+c.Database.Password+"@"+c.Database.Server+"/"+c.Database.Name+"?multiStatements=true&interpolateParams=true",
+		c.Database.Username+":"+c.Database.Password+"@"+c.Database.Server+"/"+c.Database.Name+"?multiStatements=true&interpolateParams=true&clientFoundRows=true",
 	)
 	if err != nil {
 		return nil, errors.New(`database connection "` + c.Database.Server + `": ` + err.Error())
@@ -186,16 +224,71 @@ func New(s string, empty, update bool) (*Watcher, error) {
 		m.Close()
 		return nil, errors.New("setup database schema: " + err.Error())
 	}
-	return &Watcher{
-		ck:      c.Twitter.ConsumerKey,
-		cs:      c.Twitter.ConsumerSecret,
-		sql:     m,
+	for i := range c.Admins {
+		if _, err = m.Exec("user_set", c.Admins[i], roleAdmin); err != nil {
+			m.Close()
+			return nil, errors.New("setup admin users: " + err.Error())
+		}
+	}
+	w := &Watcher{
+		sql:     &database{Map: m, times: make(map[string]*timing, len(queryStatements))},
 		bot:     b,
 		log:     l,
+		stats:   new(stats),
+		seen:    newLRU(),
+		listen:  c.Listen,
+		metrics: &metrics{errors: make(map[int]uint64)},
 		tick:    time.NewTicker(c.Timeouts.Resolve),
+		tier:    c.Twitter.tier,
+		every:   c.Timeouts.Poll,
+		limits:  c.Limits,
+		expire:  c.Timeouts.Conversation,
+		window:  c.Timeouts.Backfill,
+		history: c.Timeouts.History,
 		backoff: c.Timeouts.Backoff,
+		private: c.Private || len(c.Allowed) > 0,
 		allowed: c.Allowed,
 		blocked: c.Blocked,
-		confirm: make(map[int64]struct{}),
-	}, nil
+	}
+	t := &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: time.Second * 10, KeepAlive: time.Second * 30}).DialContext,
+		MaxIdleConns:          256,
+		IdleConnTimeout:       time.Second * 60,
+		DisableKeepAlives:     false,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   time.Second * 10,
+		ExpectContinueTimeout: time.Second * 10,
+		ResponseHeaderTimeout: time.Second * 10,
+	}
+	w.shards = make([]*shard, 1+len(c.Twitter.Accounts))
+	for i := range w.shards {
+		a := &account{log: l, file: s, index: i, client: &http.Client{Transport: t}}
+		if i == 0 {
+			a.load(&c.Twitter.keys)
+		} else {
+			a.load(&c.Twitter.Accounts[i-1])
+		}
+		w.shards[i] = &shard{
+			id:      i,
+			tag:     "watcher-" + strconv.FormatInt(b.Self.ID, 10),
+			acct:    a,
+			healthy: 1,
+		}
+		w.shards[i].api = &twitter.Client{
+			Host:       "https://api.twitter.com",
+			Client:     &http.Client{Transport: &refresher{a: a, s: &w.shards[i].status, t: t}},
+			Authorizer: a,
+		}
+		if i > 0 {
+			w.shards[i].c = make(chan uint8, 64)
+			w.shards[i].tag += "-" + strconv.Itoa(i)
+		}
+	}
+	return w, nil
+}
+
+// fatal records the error that stopped the Watcher, which is returned by Run.
+// Only the first error is kept, as each stream thread runs on its own.
+func (w *Watcher) fatal(err error) {
+	w.fail.Do(func() { w.err = err })
 }